@@ -0,0 +1,143 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"gmqtt/orm"
+	"net/http"
+	"sort"
+)
+
+/*
+
+	管理接口, 查询在线客户端及踢下线
+
+*/
+
+type ClientDetail struct {
+	orm.ConnectionInfo
+	Topics     []string `json:"topics"`     // 已订阅主题
+	Inflight   int      `json:"inflight"`   // qos 1 未确认消息数量
+	Waiting    int      `json:"waiting"`    // qos 1 等待发送消息数量
+	Persistent bool     `json:"persistent"` // 持久会话
+	Conns      int      `json:"conns"`      // 连接数量, HOST_DUPLICATE_POLICY=allow 时可以有多个
+}
+
+type ClientListReturn struct {
+	List     []ClientDetail `json:"list"`
+	PageData PageData       `json:"pageData"`
+}
+
+// 客户端详情, 有多个连接时显示最早的连接
+func clientDetail(clientId string, connArr []*orm.Connection) ClientDetail {
+	detail := ClientDetail{
+		ConnectionInfo: connArr[0].Info(),
+		Topics:         orm.SubscribeMap.Topics(clientId),
+		Persistent:     orm.SessionMap.Persistent(clientId),
+		Conns:          len(connArr),
+	}
+	detail.ClientId = clientId
+	sort.Strings(detail.Topics)
+	detail.Inflight, detail.Waiting = orm.InflightMap.Len(clientId)
+	return detail
+}
+
+// @Tags                admin
+// @Summary             在线客户端列表, 按 clientId 排序
+// @Produce             json
+// @Param 				Authorization 	header 	string 	true 	"Bearer 管理密钥"
+// @Param 				page 			query 	int 	false 	"页码, 默认 1"
+// @Param 				pageSize 		query 	int 	false 	"一页显示记录数, 默认 30, 最大 1000"
+// @Success             200 	{object} 	ClientListReturn
+// @Failure             400 	{object} 	FailReturn
+// @Router              /admin/clients [get]
+func ClientList(c *gin.Context) {
+	page, pageSize := pageQuery(c)
+
+	// 同一 clientId 的多个连接合并为一条
+	connMap := make(map[string][]*orm.Connection)
+	var clientIdArr []string
+	orm.OnlineMap.Range(func(clientId string, conn *orm.Connection) bool {
+		if _, ok := connMap[clientId]; !ok {
+			clientIdArr = append(clientIdArr, clientId)
+		}
+		connMap[clientId] = append(connMap[clientId], conn)
+		return true
+	})
+	sort.Strings(clientIdArr)
+
+	pageData := newPageData(page, pageSize, int64(len(clientIdArr)))
+	start, end := pageData.bounds()
+	list := make([]ClientDetail, 0, end-start)
+	for _, clientId := range clientIdArr[start:end] {
+		list = append(list, clientDetail(clientId, connMap[clientId]))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1,
+		"message": "OK",
+		"data": ClientListReturn{
+			List:     list,
+			PageData: pageData,
+		},
+	})
+	return
+}
+
+// @Tags                admin
+// @Summary             在线客户端详情
+// @Produce             json
+// @Param 				Authorization 	header 	string 	true 	"Bearer 管理密钥"
+// @Param 				clientId 		path 	string 	true 	"clientId"
+// @Success             200 	{object} 	ClientDetail
+// @Failure             404 	{object} 	FailReturn
+// @Router              /admin/clients/{clientId} [get]
+func ClientGet(c *gin.Context) {
+	clientId := c.Param("clientId")
+	connArr, err := orm.OnlineMap.GetAll(clientId)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1,
+		"message": "OK",
+		"data":    clientDetail(clientId, connArr),
+	})
+	return
+}
+
+// @Tags                admin
+// @Summary             踢客户端下线, websocket 连接发送关闭帧 4000 及原因
+// @Produce             json
+// @Param 				Authorization 	header 	string 	true 	"Bearer 管理密钥"
+// @Param 				clientId 		path 	string 	true 	"clientId"
+// @Param 				reason 			query 	string 	false 	"下线原因, 超过 123 字节时截断"
+// @Success             200 	{object} 	SuccessReturn
+// @Failure             404 	{object} 	FailReturn
+// @Router              /admin/clients/{clientId} [delete]
+func ClientKick(c *gin.Context) {
+	clientId := c.Param("clientId")
+	connArr, err := orm.OnlineMap.GetAll(clientId)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	reason := c.DefaultQuery("reason", "kicked by admin")
+	for _, conn := range connArr {
+		conn.CloseWithCode(orm.CloseCodeKick, reason)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1,
+		"message": "OK",
+	})
+	return
+}
@@ -0,0 +1,334 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gmqtt/orm"
+	"log"
+	"time"
+)
+
+/*
+
+	客户端连接的公共处理, json 协议与 mqtt 协议共用
+		online		注册在线, 恢复或清理会话
+		offline		发布遗嘱, 注销在线, 保留或清理会话
+		publish send subscribe unsubscribe	按 orm.AclMap 加载的规则检查主题权限
+		reauth		连接中使用新的 token 重新验证, 更新主题权限及过期时间
+	token 到期时发送关闭帧 4005 后断开
+	connect disconnect publish subscribe unsubscribe 发送 webhook 事件
+
+*/
+
+type client struct {
+	clientId string
+	username string
+	conn     *orm.Connection
+	clean    bool                // 清理会话
+	will     *orm.OnelineMessage // 遗嘱消息
+	acl      *orm.AclList        // 主题权限
+	identity *orm.Identity       // 验证结果
+	expire   *time.Timer         // token 到期时断开
+}
+
+// 消息不合法被拒绝, 返回错误后连接继续处理
+type RejectError struct {
+	Err error
+}
+
+func (e *RejectError) Error() string {
+	return e.Err.Error()
+}
+
+// 先注册在线再写入集群在线记录, 然后恢复或清理会话, 最后发送未确认及离线消息
+// connack 在发送离线消息前调用, 参数为是否恢复了持久会话, 保证 mqtt 的 CONNACK 先于其他报文发送
+// 注册在线后实时收到的消息暂存在连接, 未确认及离线消息发送完后再发送
+// clientId 已在线时按 HOST_DUPLICATE_POLICY 处理, reject 时返回 orm.ErrClientExist, 不影响已在线连接的会话
+func (cl *client) online(connack func(present bool)) error {
+	cl.conn.SetClient(cl.clientId, cl.username)
+	cl.conn.SetIdentity(cl.identity)
+	policy := orm.Config.Duplicate
+	join := false // allow 时加入已在线的 clientId
+	switch policy {
+	case orm.DuplicateTakeover:
+		takeover(cl.clientId)
+	case orm.DuplicateAllow:
+		join = orm.OnlineMap.Exist(cl.clientId) == nil
+	}
+	// 注册在线前取出未确认的消息, 不包含注册后实时收到的消息
+	var backlog []orm.OnelineMessage
+	if !join && (policy == orm.DuplicateTakeover || orm.OnlineMap.Exist(cl.clientId) != nil) {
+		backlog = orm.InflightMap.Resend(cl.clientId)
+	}
+	cl.conn.Hold()
+	defer cl.conn.Release(nil)
+	var err error
+	switch policy {
+	case orm.DuplicateTakeover:
+		_, err = orm.OnlineMap.Replace(cl.clientId, cl.conn)
+	case orm.DuplicateAllow:
+		err = orm.OnlineMap.Add(cl.clientId, cl.conn)
+	default:
+		err = orm.OnlineMap.Set(cl.clientId, cl.conn)
+	}
+	if err != nil {
+		return err
+	}
+	force := policy == orm.DuplicateTakeover || policy == orm.DuplicateAllow
+	if err := orm.NodeMap.Register(cl.conn.Info(), force); err != nil {
+		// 其他节点已在线, 撤销本节点的注册
+		orm.OnlineMap.Unset(cl.clientId, cl.conn)
+		orm.NodeMap.Unregister(cl.clientId)
+		return err
+	}
+
+	present := false
+	if join {
+		// 共用已在线连接的会话及订阅
+		cl.clean = !orm.SessionMap.Persistent(cl.clientId)
+		present = len(orm.SubscribeMap.Topics(cl.clientId)) > 0
+	} else {
+		if !cl.clean {
+			flag, err := SessionOpen(cl.clientId)
+			if err != nil {
+				cl.conn.WriteError("", err)
+				cl.clean = true
+			}
+			present = flag
+			if err == nil && policy == orm.DuplicateTakeover {
+				present = SessionHandover(cl.clientId) || present
+			}
+		}
+		if cl.clean && policy == orm.DuplicateTakeover {
+			// 接管旧连接的订阅, 只清理持久会话
+			orm.SessionMap.Clean(cl.clientId)
+			present = len(orm.SubscribeMap.Topics(cl.clientId)) > 0
+		} else if cl.clean {
+			SessionClean(cl.clientId)
+		}
+	}
+	if connack != nil {
+		connack(present)
+	}
+	EventConnected(cl.conn)
+	cl.hook(orm.WebhookEvent{Event: "connect"})
+	cl.watchExpire()
+	if !join && !cl.clean {
+		backlog = append(backlog, SessionReplay(cl.clientId)...)
+	}
+	cl.conn.Release(backlog)
+	return nil
+}
+
+// 注销在线, 异常断开时发布遗嘱消息
+// 被接管或 clientId 还有其他连接时, 保留会话及订阅
+func (cl *client) offline() {
+	if cl.expire != nil {
+		cl.expire.Stop()
+	}
+	reason := cl.conn.CloseReason()
+	if cl.will != nil {
+		log.Println("[will]", cl.clientId, reason)
+		if err := cl.acl.Check(orm.AclPublish, cl.will.Topic); err != nil {
+			log.Println("[will]", cl.clientId, cl.will.Topic, err.Error())
+		} else {
+			WillPublish(cl.clientId, cl.will)
+		}
+	}
+	if reason != orm.CloseReasonTakeover && reason != orm.CloseReasonTakeoverRemote {
+		// 被接管时新连接已发布 connected, 不发布 disconnected
+		EventDisconnected(cl.conn, reason)
+	}
+	cl.hook(orm.WebhookEvent{Event: "disconnect", Reason: reason})
+	last := orm.OnlineMap.Remove(cl.clientId, cl.conn)
+	if reason == orm.CloseReasonTakeover || !last {
+		return
+	}
+	orm.NodeMap.Unregister(cl.clientId)
+	if reason == orm.CloseReasonTakeoverRemote {
+		// 持久会话由其他节点从 redis 恢复
+		orm.SubscribeMap.RemoveClient(cl.clientId)
+		orm.SessionMap.Release(cl.clientId)
+		return
+	}
+	if cl.clean {
+		orm.SubscribeMap.RemoveClient(cl.clientId)
+	} else {
+		SessionClose(cl.clientId)
+	}
+}
+
+// 断开 clientId 的旧连接, 旧连接在其他节点时通过节点队列通知
+func takeover(clientId string) {
+	if connArr, err := orm.OnlineMap.GetAll(clientId); err == nil {
+		for _, conn := range connArr {
+			conn.CloseWithCode(orm.CloseCodeTakeover, orm.CloseReasonTakeover)
+		}
+		return
+	}
+	node, err := orm.NodeMap.Lookup(clientId)
+	if err != nil || node == orm.NodeMap.Name() {
+		return
+	}
+	j, err := json.Marshal(orm.OnelineMessage{
+		Action:   "takeover",
+		ClientId: clientId,
+	})
+	if err != nil {
+		return
+	}
+	if err := orm.MQ.PublishNode(node, string(j)); err != nil {
+		log.Println("[takeover]", clientId, node, err.Error())
+	}
+}
+
+// 客户端主动断开, 不发布遗嘱
+func (cl *client) disconnect() {
+	cl.will = nil
+	cl.conn.CloseWithReason("disconnect")
+}
+
+// 发布消息, 返回消息id
+func (cl *client) publish(onelineMessage orm.OnelineMessage) (string, error) {
+	if err := orm.CheckTopicName(onelineMessage.Topic); err != nil {
+		return "", &RejectError{Err: err}
+	}
+	if orm.IsSysTopic(onelineMessage.Topic) {
+		return "", &RejectError{Err: errSysTopic}
+	}
+	if err := cl.acl.Check(orm.AclPublish, onelineMessage.Topic); err != nil {
+		return "", &RejectError{Err: err}
+	}
+	onelineMessage.Action = "publish"
+	onelineMessage.Id = ""
+	onelineMessage.From = cl.clientId
+	id, err := Publish(onelineMessage)
+	if err == nil {
+		cl.hook(orm.WebhookEvent{
+			Event:   "publish",
+			Topic:   onelineMessage.Topic,
+			Message: onelineMessage.Message,
+			Qos:     onelineMessage.Qos,
+		})
+	}
+	return id, err
+}
+
+// 发送给指定客户端, 返回消息id
+func (cl *client) send(onelineMessage orm.OnelineMessage) (string, error) {
+	if onelineMessage.ClientId == "" || onelineMessage.ClientId == "*" {
+		return "", &RejectError{Err: errors.New("请指定接收方clientId")}
+	}
+	if err := orm.CheckTopicName(onelineMessage.Topic); err != nil {
+		return "", &RejectError{Err: err}
+	}
+	if orm.IsSysTopic(onelineMessage.Topic) {
+		return "", &RejectError{Err: errSysTopic}
+	}
+	if err := cl.acl.Check(orm.AclPublish, onelineMessage.Topic); err != nil {
+		return "", &RejectError{Err: err}
+	}
+	onelineMessage.Id = ""
+	onelineMessage.From = cl.clientId
+	id, err := SendTo(onelineMessage)
+	if err == orm.ErrClientOffline {
+		return "", &RejectError{Err: err}
+	}
+	return id, err
+}
+
+// 订阅主题, 返回实际订阅的 qos
+func (cl *client) subscribe(topic string, qos int64) (int64, error) {
+	if qos > 1 {
+		qos = 1
+	}
+	if err := orm.CheckTopicFilter(topic); err != nil {
+		return 0, &RejectError{Err: err}
+	}
+	if err := cl.acl.Check(orm.AclSubscribe, topic); err != nil {
+		return 0, &RejectError{Err: err}
+	}
+	if err := SubscribeAdd(orm.OnelineMessage{
+		Action:   "subscribe",
+		ClientId: cl.clientId,
+		Topic:    topic,
+		Qos:      qos,
+	}); err != nil {
+		return 0, &RejectError{Err: err}
+	}
+	cl.hook(orm.WebhookEvent{Event: "subscribe", Topic: topic, Qos: qos})
+	return qos, nil
+}
+
+// 订阅成功后发送保留消息
+func (cl *client) retain(topic string, qos int64) {
+	SendRetain(orm.OnelineMessage{
+		Action:   "subscribe",
+		ClientId: cl.clientId,
+		Topic:    topic,
+		Qos:      qos,
+	})
+}
+
+// 取消订阅
+func (cl *client) unsubscribe(topic string) {
+	SubscribeDelete(orm.OnelineMessage{
+		Action:   "unsubscribe",
+		ClientId: cl.clientId,
+		Topic:    topic,
+	})
+	cl.hook(orm.WebhookEvent{Event: "unsubscribe", Topic: topic})
+}
+
+// token 到期时断开连接, 重新验证后按新的过期时间计时
+func (cl *client) watchExpire() {
+	if cl.expire != nil {
+		cl.expire.Stop()
+	}
+	if cl.identity == nil || cl.identity.ExpiresAt <= 0 {
+		return
+	}
+	conn := cl.conn
+	cl.expire = time.AfterFunc(time.Until(time.Unix(cl.identity.ExpiresAt, 0)), func() {
+		conn.CloseWithCode(orm.CloseCodeExpired, orm.CloseReasonTokenExpired)
+	})
+}
+
+// 使用新的 token 重新验证, 只能是同一帐号
+// 验证通过后重新加载主题权限, 取消不再允许的订阅, 失败时保留原来的验证结果
+func (cl *client) reauth(ctx context.Context, credentials orm.Credentials) error {
+	credentials.ClientId = cl.clientId
+	identity, err := orm.Auth.Authenticate(ctx, credentials)
+	if err != nil {
+		return err
+	}
+	if cl.identity != nil && (identity.Method != cl.identity.Method || identity.UserId != cl.identity.UserId) {
+		return errors.New("只能使用同一帐号重新验证")
+	}
+	acl, err := orm.AclMap.Load(identity, cl.clientId)
+	if err != nil {
+		return err
+	}
+
+	cl.identity = identity
+	cl.acl = acl
+	cl.conn.SetIdentity(identity)
+	for _, topic := range orm.SubscribeMap.Topics(cl.clientId) {
+		if err := acl.Check(orm.AclSubscribe, topic); err != nil {
+			cl.unsubscribe(topic)
+		}
+	}
+	cl.watchExpire()
+	return nil
+}
+
+// 发送 webhook 事件
+func (cl *client) hook(event orm.WebhookEvent) {
+	info := cl.conn.Info()
+	event.ClientId = cl.clientId
+	event.Username = info.Username
+	event.Ip = info.Ip
+	event.Node = orm.NodeMap.Name()
+	orm.Webhook.Send(event)
+}
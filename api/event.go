@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"gmqtt/orm"
+	"log"
+	"time"
+)
+
+/*
+
+	在线状态事件, 通过中间件发布给订阅者
+		$SYS/clients/{clientId}/connected		连接成功
+		$SYS/clients/{clientId}/disconnected	断开连接, reason 为断开原因
+	消息内容为 ClientEvent json, 连接被接管时旧连接不发布 disconnected
+
+*/
+
+var errSysTopic = errors.New("$SYS主题只能由服务端发布")
+
+type ClientEvent struct {
+	ClientId string `json:"clientId"`
+	Username string `json:"username"`
+	Ip       string `json:"ip"`
+	Protocol string `json:"protocol"` // json mqtt
+	Node     string `json:"node"`
+	Reason   string `json:"reason,omitempty"` // 断开原因
+	Time     int64  `json:"time"`             // 事件时间 unix
+}
+
+func EventConnected(conn *orm.Connection) {
+	publishEvent("connected", conn, "")
+}
+
+func EventDisconnected(conn *orm.Connection, reason string) {
+	publishEvent("disconnected", conn, reason)
+}
+
+func publishEvent(event string, conn *orm.Connection, reason string) {
+	info := conn.Info()
+	topic := orm.SysTopicPrefix + "clients/" + info.ClientId + "/" + event
+	if err := orm.CheckTopicName(topic); err != nil {
+		return
+	}
+	j, err := json.Marshal(ClientEvent{
+		ClientId: info.ClientId,
+		Username: info.Username,
+		Ip:       info.Ip,
+		Protocol: info.Protocol,
+		Node:     orm.NodeMap.Name(),
+		Reason:   reason,
+		Time:     time.Now().Unix(),
+	})
+	if err != nil {
+		return
+	}
+	if _, err := Publish(orm.OnelineMessage{
+		Action:   "publish",
+		ClientId: "*",
+		Topic:    topic,
+		Message:  string(j),
+	}); err != nil {
+		log.Println("[event]", topic, err.Error())
+	}
+}
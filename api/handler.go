@@ -1,5 +1,17 @@
 package api
 
+import (
+	"github.com/gin-gonic/gin"
+	"math"
+	"strconv"
+)
+
+const (
+	pageSizeDefault = 30
+	pageSizeMax     = 1000
+	pageMax         = math.MaxInt64 / pageSizeMax // 页码上限, 计算 offset 不溢出
+)
+
 type FailReturn struct {
 	Code    int64  `json:"code" example:"-1"`    //	code 1 正常  其他出现错误
 	Message string `json:"message" example:"描述"` //	错误描述
@@ -16,3 +28,44 @@ type PageData struct {
 	TotalSize int64 `json:"totalSize" example:"100"` //	记录总数
 	TotalPage int64 `json:"totalPage" example:"4"`   //	总页面数量
 }
+
+// 读取分页参数 page pageSize, page 至少为 1, pageSize 限制在 1~1000
+func pageQuery(c *gin.Context) (int64, int64) {
+	page, _ := strconv.ParseInt(c.DefaultQuery("page", "1"), 10, 64)
+	pageSize, _ := strconv.ParseInt(c.DefaultQuery("pageSize", strconv.Itoa(pageSizeDefault)), 10, 64)
+	if page <= 0 {
+		page = 1
+	}
+	if page > pageMax {
+		page = pageMax
+	}
+	if pageSize <= 0 {
+		pageSize = pageSizeDefault
+	}
+	if pageSize > pageSizeMax {
+		pageSize = pageSizeMax
+	}
+	return page, pageSize
+}
+
+func newPageData(page, pageSize, total int64) PageData {
+	return PageData{
+		Page:      page,
+		PageSize:  pageSize,
+		TotalSize: total,
+		TotalPage: (total + pageSize - 1) / pageSize,
+	}
+}
+
+// 当前页的起始位置, 超出总数时为空
+func (p PageData) bounds() (int64, int64) {
+	start := (p.Page - 1) * p.PageSize
+	if start > p.TotalSize {
+		start = p.TotalSize
+	}
+	end := start + p.PageSize
+	if end > p.TotalSize {
+		end = p.TotalSize
+	}
+	return start, end
+}
@@ -2,10 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"gmqtt/orm"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 /*
@@ -18,9 +21,16 @@ import (
 // @Tags                mqtt链接
 // @Summary             连接长链接
 // @Produce             json
-// @Param 				username 	query 	string 	true 	"帐号/token"
+// @Param 				Authorization 	header 	string 	false 	"Bearer {token} 或 Basic 帐号密码"
+// @Param 				Sec-WebSocket-Protocol 	header 	string 	false 	"子协议 access_token.{token}, 可同时带上 json, 回应 json 或 access_token 子协议"
+// @Param 				username 	query 	string 	false 	"帐号/token, HOST_AUTH_FORBID_QUERY 开启时不能使用"
 // @Param 				password 	query 	string 	false 	"密码"
 // @Param 				clientId 	query 	string 	true 	"clientId"
+// @Param 				clean 		query 	bool 	false 	"清理会话, 默认 true, false 时保留订阅及离线消息"
+// @Param 				willTopic 	query 	string 	false 	"遗嘱消息主题, 连接异常断开时发布"
+// @Param 				willMessage query 	string 	false 	"遗嘱消息内容"
+// @Param 				willQos 	query 	int 	false 	"遗嘱消息qos"
+// @Param 				willRetain 	query 	bool 	false 	"遗嘱消息是否保留"
 // @Success             200 	{object} 	SuccessReturn
 // @Failure             400 	{object} 	FailReturn
 // @Router              /mqtt [get]
@@ -36,16 +46,54 @@ func Mqtt(c *gin.Context) {
 	defer ws.Close()
 
 	clientId := c.GetString("clientId")
-	if err := orm.OnlineMap.Exist(clientId); err == nil {
-		return
+	clean := true
+	if value, err := strconv.ParseBool(c.DefaultQuery("clean", "true")); err == nil {
+		clean = value
+	}
+	will, err := WillQuery(c)
+	if err != nil {
+		ws.WriteError(c.Query("willTopic"), err)
 	}
 
-	if err := orm.OnlineMap.Set(clientId, ws); err != nil {
+	cl := &client{
+		clientId: clientId,
+		username: c.GetString("username"),
+		conn:     ws,
+		clean:    clean,
+		will:     will,
+	}
+	identity, _ := c.Value(orm.IdentityKey).(*orm.Identity)
+	connected := false // 已处理 connect 消息
+	if identity == nil && orm.Config.AuthFrame {
+		onelineMessage, authIdentity, err := connectFrame(c, ws, clientId)
+		if err != nil {
+			ws.CloseWithCode(orm.CloseCodeAuth, err.Error())
+			return
+		}
+		identity, connected = authIdentity, true
+		cl.username = identity.Username
+		if onelineMessage.Will != nil {
+			if err := WillCheck(onelineMessage.Will); err != nil {
+				ws.WriteError(onelineMessage.Will.Topic, err)
+			} else {
+				cl.will = onelineMessage.Will
+			}
+		}
+	}
+	cl.identity = identity
+	if cl.acl, err = orm.AclMap.Load(identity, clientId); err != nil {
+		ws.WriteError("", err)
+		return
+	}
+	if err := cl.online(nil); err != nil {
+		if err == orm.ErrClientExist {
+			ws.CloseWithCode(orm.CloseCodeDuplicate, err.Error())
+		}
 		return
 	}
-	defer orm.OnlineMap.Del(clientId)
+	defer cl.offline()
 
-	for {
+	for first := !connected; ; first = false {
 		j, err := ws.ReadMessage()
 		if err != nil {
 			goto END
@@ -54,19 +102,81 @@ func Mqtt(c *gin.Context) {
 		if err := json.Unmarshal(j, &onelineMessage); err != nil {
 			continue
 		}
-		onelineMessage.ClientId = clientId
 
 		switch onelineMessage.Action {
+		case "connect":
+			if !first {
+				ws.WriteError("", errors.New("connect只能作为第一条消息"))
+				continue
+			}
+			if onelineMessage.Will != nil {
+				if err := WillCheck(onelineMessage.Will); err != nil {
+					ws.WriteError(onelineMessage.Will.Topic, err)
+					continue
+				}
+				cl.will = onelineMessage.Will
+			}
+		case "disconnect":
+			cl.disconnect()
+			goto END
 		case "publish":
-			if err := Publish(string(j)); err != nil {
+			id, err := cl.publish(onelineMessage)
+			if err != nil {
+				if _, ok := err.(*RejectError); ok {
+					ws.WriteError(onelineMessage.Topic, err)
+					continue
+				}
+				goto END
+			}
+			if onelineMessage.Qos > 0 {
+				ws.Send(orm.OnelineMessage{
+					Action: "puback",
+					Id:     id,
+					Topic:  onelineMessage.Topic,
+				})
+			}
+		case "send":
+			id, err := cl.send(onelineMessage)
+			if err != nil {
+				if _, ok := err.(*RejectError); ok {
+					ws.WriteError(onelineMessage.Topic, err)
+					continue
+				}
 				goto END
 			}
+			if onelineMessage.Qos > 0 {
+				ws.Send(orm.OnelineMessage{
+					Action:   "puback",
+					Id:       id,
+					ClientId: onelineMessage.ClientId,
+					Topic:    onelineMessage.Topic,
+				})
+			}
 		case "subscribe":
-			SubscribeAdd(onelineMessage, func(s string) {
-				ws.WriteMessage([]byte(s))
-			})
+			qos, err := cl.subscribe(onelineMessage.Topic, onelineMessage.Qos)
+			if err != nil {
+				ws.WriteError(onelineMessage.Topic, err)
+				continue
+			}
+			cl.retain(onelineMessage.Topic, qos)
 		case "unsubscribe":
-			SubscribeDelete(onelineMessage)
+			cl.unsubscribe(onelineMessage.Topic)
+		case "ack":
+			Ack(clientId, onelineMessage.Id)
+		case "auth":
+			err := cl.reauth(c.Request.Context(), orm.Credentials{
+				Token:    onelineMessage.Token,
+				Username: onelineMessage.Username,
+				Password: onelineMessage.Password,
+			})
+			if err != nil {
+				ws.WriteError("", err)
+				continue
+			}
+			ws.Send(orm.OnelineMessage{
+				Action:  "auth",
+				Message: "OK",
+			})
 		}
 	}
 
@@ -74,3 +184,29 @@ END:
 	fmt.Println("close")
 	ws.Close()
 }
+
+// 读取第一条 connect 消息验证帐号, HOST_AUTH_FRAME 开启且握手时没有帐号信息时使用
+func connectFrame(c *gin.Context, ws *orm.Connection, clientId string) (*orm.OnelineMessage, *orm.Identity, error) {
+	timer := time.AfterFunc(mqttConnectTimeout, func() {
+		ws.CloseWithCode(orm.CloseCodeAuth, "connect timeout")
+	})
+	j, err := ws.ReadMessage()
+	timer.Stop()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var onelineMessage orm.OnelineMessage
+	if err := json.Unmarshal(j, &onelineMessage); err != nil || onelineMessage.Action != "connect" {
+		return nil, nil, errors.New("请先发送connect消息验证帐号")
+	}
+	identity, err := orm.Auth.Authenticate(c.Request.Context(), orm.Credentials{
+		Username: onelineMessage.Username,
+		Password: onelineMessage.Password,
+		ClientId: clientId,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &onelineMessage, identity, nil
+}
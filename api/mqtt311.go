@@ -0,0 +1,322 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gmqtt/orm"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+
+	mqtt 3.1.1 协议
+		CONNECT 中的 username password 使用 HOST_AUTH 验证
+		PUBLISH 发送给所有订阅者, 服务端最高支持 qos 1, 收到 qos 2 按 PUBREC PUBREL PUBCOMP 流程应答
+		订阅及消息分发与 /mqtt json 协议共用
+
+*/
+
+const mqttConnectTimeout = 10 * time.Second // 连接后等待 CONNECT 的时间
+
+// @Tags                mqtt链接
+// @Summary             mqtt 3.1.1 over websocket, 使用 mqtt 子协议, 在 CONNECT 报文中验证帐号
+// @Success             101
+// @Failure             400 	{object} 	FailReturn
+// @Router              /mqtt/ws [get]
+func MqttWs(c *gin.Context) {
+	conn, err := orm.InitMqttConnection(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+	ServeMqtt(conn)
+}
+
+// 处理 mqtt 报文, 连接关闭后返回
+func ServeMqtt(conn *orm.Connection) {
+	defer conn.Close()
+
+	timer := time.AfterFunc(mqttConnectTimeout, func() {
+		conn.CloseWithReason("connect timeout")
+	})
+	data, err := conn.ReadMessage()
+	timer.Stop()
+	if err != nil {
+		return
+	}
+	packet, err := orm.DecodePacket(data)
+	if err != nil {
+		return
+	}
+	connect, ok := packet.(*orm.ConnectPacket)
+	if !ok {
+		return
+	}
+
+	cl, returnCode := mqttConnect(conn, connect)
+	if returnCode != orm.ConnackAccepted {
+		conn.WriteAndClose((&orm.ConnackPacket{ReturnCode: returnCode}).Encode(), "connect refused")
+		return
+	}
+
+	session := &mqttSession{}
+	conn.SetEncoder(session.encode)
+	if err := cl.online(func(present bool) {
+		conn.WriteMessage((&orm.ConnackPacket{
+			SessionPresent: present,
+			ReturnCode:     orm.ConnackAccepted,
+		}).Encode())
+	}); err != nil {
+		if err == orm.ErrClientExist {
+			conn.WriteAndClose((&orm.ConnackPacket{ReturnCode: orm.ConnackIdentifierReject}).Encode(), err.Error())
+		}
+		return
+	}
+	defer cl.offline()
+	conn.KeepAlive(time.Duration(connect.KeepAlive) * time.Second)
+
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		packet, err := orm.DecodePacket(data)
+		if err != nil {
+			log.Println("[mqtt]", cl.clientId, err.Error())
+			conn.CloseWithReason(err.Error())
+			return
+		}
+
+		switch p := packet.(type) {
+		case *orm.PublishPacket:
+			// qos 2 重复发送的消息只应答
+			if p.Qos == 2 && session.received(p.PacketId) {
+				conn.WriteMessage((&orm.AckPacket{Type: orm.PacketPubrec, PacketId: p.PacketId}).Encode())
+				continue
+			}
+			qos := int64(p.Qos)
+			if qos > 1 {
+				qos = 1
+			}
+			if _, err := cl.publish(orm.OnelineMessage{
+				ClientId: "*",
+				Topic:    p.Topic,
+				Message:  string(p.Payload),
+				Qos:      qos,
+				Retain:   p.Retain,
+			}); err != nil {
+				if _, ok := err.(*RejectError); !ok {
+					conn.CloseWithReason(err.Error())
+					return
+				}
+				log.Println("[mqtt]", cl.clientId, p.Topic, err.Error())
+			}
+			switch p.Qos {
+			case 1:
+				conn.WriteMessage((&orm.AckPacket{Type: orm.PacketPuback, PacketId: p.PacketId}).Encode())
+			case 2:
+				session.receive(p.PacketId)
+				conn.WriteMessage((&orm.AckPacket{Type: orm.PacketPubrec, PacketId: p.PacketId}).Encode())
+			}
+		case *orm.AckPacket:
+			switch p.Type {
+			case orm.PacketPuback:
+				if id, ok := session.ack(p.PacketId); ok {
+					Ack(cl.clientId, id)
+				}
+			case orm.PacketPubrel:
+				session.release(p.PacketId)
+				conn.WriteMessage((&orm.AckPacket{Type: orm.PacketPubcomp, PacketId: p.PacketId}).Encode())
+			}
+		case *orm.SubscribePacket:
+			suback := &orm.SubackPacket{PacketId: p.PacketId}
+			for i, topic := range p.Topics {
+				qos, err := cl.subscribe(topic, int64(p.Qos[i]))
+				if err != nil {
+					suback.ReturnCodes = append(suback.ReturnCodes, orm.SubackFailure)
+					continue
+				}
+				suback.ReturnCodes = append(suback.ReturnCodes, byte(qos))
+			}
+			conn.WriteMessage(suback.Encode())
+			for i, topic := range p.Topics {
+				if suback.ReturnCodes[i] != orm.SubackFailure {
+					cl.retain(topic, int64(suback.ReturnCodes[i]))
+				}
+			}
+		case *orm.UnsubscribePacket:
+			for _, topic := range p.Topics {
+				cl.unsubscribe(topic)
+			}
+			conn.WriteMessage((&orm.AckPacket{Type: orm.PacketUnsuback, PacketId: p.PacketId}).Encode())
+		case *orm.EmptyPacket:
+			switch p.Type {
+			case orm.PacketPingreq:
+				conn.WriteMessage((&orm.EmptyPacket{Type: orm.PacketPingresp}).Encode())
+			case orm.PacketDisconnect:
+				cl.disconnect()
+				return
+			}
+		default:
+			// 重复的 CONNECT 属于协议错误
+			conn.CloseWithReason("protocol error")
+			return
+		}
+	}
+}
+
+// 校验 CONNECT, 返回 connack 返回码
+func mqttConnect(conn *orm.Connection, connect *orm.ConnectPacket) (*client, byte) {
+	if !(connect.ProtocolName == "MQTT" && connect.ProtocolLevel == 4) &&
+		!(connect.ProtocolName == "MQIsdp" && connect.ProtocolLevel == 3) {
+		return nil, orm.ConnackProtocolVersion
+	}
+
+	identity, err := orm.Auth.Authenticate(context.Background(), orm.Credentials{
+		Username: connect.Username,
+		Password: connect.Password,
+		ClientId: connect.ClientId,
+	})
+	if err != nil {
+		if authErr, ok := err.(*orm.AuthError); ok && authErr.Status == http.StatusInternalServerError {
+			return nil, orm.ConnackServerUnavailable
+		}
+		return nil, orm.ConnackBadUsername
+	}
+
+	clientId := connect.ClientId
+	if clientId == "" {
+		if !connect.CleanSession {
+			return nil, orm.ConnackIdentifierReject
+		}
+		clientId = "auto-" + orm.NewMessageId()
+	}
+
+	cl := &client{
+		clientId: clientId,
+		username: identity.Username,
+		conn:     conn,
+		clean:    connect.CleanSession,
+		identity: identity,
+	}
+	acl, err := orm.AclMap.Load(identity, clientId)
+	if err == orm.ErrAclPlaceholder {
+		return nil, orm.ConnackNotAuthorized
+	}
+	if err != nil {
+		return nil, orm.ConnackServerUnavailable
+	}
+	cl.acl = acl
+	if connect.WillFlag {
+		will := &orm.OnelineMessage{
+			Topic:   connect.WillTopic,
+			Message: string(connect.WillMessage),
+			Qos:     int64(connect.WillQos),
+			Retain:  connect.WillRetain,
+		}
+		if err := WillCheck(will); err != nil {
+			return nil, orm.ConnackNotAuthorized
+		}
+		if err := cl.acl.Check(orm.AclPublish, will.Topic); err != nil {
+			return nil, orm.ConnackNotAuthorized
+		}
+		cl.will = will
+	}
+	return cl, orm.ConnackAccepted
+}
+
+// mqtt 连接的报文标识, 服务端发送的 qos 1 消息使用报文标识与消息id对应
+type mqttSession struct {
+	mutex    sync.Mutex
+	packetId uint16
+	idMap    map[uint16]string // map[报文标识]消息id
+	msgMap   map[string]uint16 // map[消息id]报文标识
+	qos2Map  map[uint16]bool   // 已收到未释放的 qos 2 报文标识
+}
+
+// 把消息编码为 PUBLISH 报文, 其他消息不发送
+func (s *mqttSession) encode(msg orm.OnelineMessage) ([]byte, error) {
+	if msg.Action != "publish" {
+		return nil, nil
+	}
+	p := &orm.PublishPacket{
+		Dup:     msg.Dup,
+		Qos:     byte(msg.Qos),
+		Retain:  msg.Retain,
+		Topic:   msg.Topic,
+		Payload: []byte(msg.Message),
+	}
+	if p.Qos > 0 {
+		packetId, err := s.allocate(msg.Id)
+		if err != nil {
+			return nil, err
+		}
+		p.PacketId = packetId
+	}
+	return p.Encode(), nil
+}
+
+// 分配报文标识, 重发的消息使用原来的报文标识
+func (s *mqttSession) allocate(id string) (uint16, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.idMap == nil {
+		s.idMap = make(map[uint16]string)
+		s.msgMap = make(map[string]uint16)
+	}
+	if packetId, ok := s.msgMap[id]; ok {
+		return packetId, nil
+	}
+	for i := 0; i < 0xffff; i++ {
+		s.packetId++
+		if s.packetId == 0 {
+			s.packetId = 1
+		}
+		if _, ok := s.idMap[s.packetId]; !ok {
+			s.idMap[s.packetId] = id
+			s.msgMap[id] = s.packetId
+			return s.packetId, nil
+		}
+	}
+	return 0, errors.New("mqtt报文标识已用完")
+}
+
+// 客户端 PUBACK, 返回对应的消息id
+func (s *mqttSession) ack(packetId uint16) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id, ok := s.idMap[packetId]
+	if ok {
+		delete(s.idMap, packetId)
+		delete(s.msgMap, id)
+	}
+	return id, ok
+}
+
+func (s *mqttSession) receive(packetId uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.qos2Map == nil {
+		s.qos2Map = make(map[uint16]bool)
+	}
+	s.qos2Map[packetId] = true
+}
+func (s *mqttSession) received(packetId uint16) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.qos2Map[packetId]
+}
+func (s *mqttSession) release(packetId uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.qos2Map, packetId)
+}
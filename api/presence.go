@@ -0,0 +1,74 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"gmqtt/orm"
+	"net/http"
+)
+
+type PresenceListReturn struct {
+	List     []orm.Presence `json:"list"`
+	PageData PageData       `json:"pageData"`
+}
+
+// @Tags                admin
+// @Summary             集群在线客户端列表
+// @Produce             json
+// @Param 				Authorization 	header 	string 	true 	"Bearer 管理密钥"
+// @Param 				page 			query 	int 	false 	"页码, 默认 1"
+// @Param 				pageSize 		query 	int 	false 	"一页显示记录数, 默认 30, 最大 1000"
+// @Success             200 	{object} 	PresenceListReturn
+// @Failure             500 	{object} 	FailReturn
+// @Router              /admin/presence [get]
+func PresenceList(c *gin.Context) {
+	page, pageSize := pageQuery(c)
+
+	list, total, err := orm.NodeMap.List((page-1)*pageSize, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1,
+		"message": "OK",
+		"data": PresenceListReturn{
+			List:     list,
+			PageData: newPageData(page, pageSize, total),
+		},
+	})
+	return
+}
+
+// @Tags                admin
+// @Summary             查询客户端在集群中的在线状态
+// @Produce             json
+// @Param 				Authorization 	header 	string 	true 	"Bearer 管理密钥"
+// @Param 				clientId 		path 	string 	true 	"clientId"
+// @Success             200 	{object} 	orm.Presence
+// @Failure             404 	{object} 	FailReturn
+// @Router              /admin/presence/{clientId} [get]
+func PresenceGet(c *gin.Context) {
+	presence, err := orm.NodeMap.Get(c.Param("clientId"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == orm.ErrClientOffline {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1,
+		"message": "OK",
+		"data":    presence,
+	})
+	return
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gmqtt/orm"
+	"net/http"
+)
+
+/*
+
+	后台服务通过 http 发布消息, 与客户端发布使用相同的中间件
+
+*/
+
+const publishBatchMax = 1000 // 批量发布最大条数
+
+type PublishRequest struct {
+	Topic    string `json:"topic" example:"device/1/cmd"` // 主题, 不能包含通配符
+	ClientId string `json:"clientId" example:"*"`         // 接收方 clientId, 为空或 * 发送给所有订阅者
+	Message  string `json:"message" example:"hello"`      // 消息内容
+	Qos      int64  `json:"qos" example:"0"`              // 0 最多一次	1 至少一次
+	Retain   bool   `json:"retain" example:"false"`       // 保留消息
+}
+
+type PublishResult struct {
+	Id      string `json:"id,omitempty"`      // 消息id
+	Message string `json:"message,omitempty"` // 发布失败的原因
+}
+
+// 校验后转换为消息
+func (p *PublishRequest) onelineMessage() (orm.OnelineMessage, error) {
+	if err := orm.CheckTopicName(p.Topic); err != nil {
+		return orm.OnelineMessage{}, err
+	}
+	if p.Qos < 0 || p.Qos > 2 {
+		return orm.OnelineMessage{}, errors.New("qos错误")
+	}
+	if p.ClientId == "" {
+		p.ClientId = "*"
+	}
+	return orm.OnelineMessage{
+		Action:   "publish",
+		ClientId: p.ClientId,
+		Topic:    p.Topic,
+		Message:  p.Message,
+		Qos:      p.Qos,
+		Retain:   p.Retain,
+	}, nil
+}
+
+// @Tags                publish
+// @Summary             发布消息
+// @Produce             json
+// @Param 				Authorization 	header 	string 			true 	"Bearer 管理密钥"
+// @Param 				body 			body 	PublishRequest 	true 	"消息"
+// @Success             200 	{object} 	PublishResult
+// @Failure             400 	{object} 	FailReturn
+// @Router              /publish [post]
+func HttpPublish(c *gin.Context) {
+	var req PublishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+	onelineMessage, err := req.onelineMessage()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	id, err := Publish(onelineMessage)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1,
+		"message": "OK",
+		"data":    PublishResult{Id: id},
+	})
+	return
+}
+
+// @Tags                publish
+// @Summary             批量发布消息, 按顺序返回每条消息的结果, 单条失败不影响其他消息
+// @Produce             json
+// @Param 				Authorization 	header 	string 				true 	"Bearer 管理密钥"
+// @Param 				body 			body 	[]PublishRequest 	true 	"消息列表, 最多 1000 条"
+// @Success             200 	{array} 	PublishResult
+// @Failure             400 	{object} 	FailReturn
+// @Router              /publish/batch [post]
+func HttpPublishBatch(c *gin.Context) {
+	var reqArr []PublishRequest
+	if err := c.ShouldBindJSON(&reqArr); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+	if len(reqArr) <= 0 || len(reqArr) > publishBatchMax {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": "消息数量错误",
+		})
+		return
+	}
+
+	resultArr := make([]PublishResult, 0, len(reqArr))
+	for _, req := range reqArr {
+		onelineMessage, err := req.onelineMessage()
+		if err == nil {
+			var id string
+			if id, err = Publish(onelineMessage); err == nil {
+				resultArr = append(resultArr, PublishResult{Id: id})
+				continue
+			}
+		}
+		resultArr = append(resultArr, PublishResult{Message: err.Error()})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1,
+		"message": "OK",
+		"data":    resultArr,
+	})
+	return
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"gmqtt/orm"
+	"log"
+	"time"
+)
+
+/*
+
+	qos 1 消息确认及重发
+
+*/
+
+// 启动重发监控
+func QosRun() {
+	orm.InflightMap.Init(orm.Config.Qos)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			msgMap := orm.InflightMap.Timeout(func(clientId string) bool {
+				return orm.OnlineMap.Exist(clientId) == nil
+			})
+			for clientId, msgArr := range msgMap {
+				for _, msg := range msgArr {
+					Send(clientId, msg)
+				}
+			}
+		}
+	}()
+}
+
+// 发送消息给在线的客户端, clientId 有多个连接时全部发送
+func Send(clientId string, onelineMessage orm.OnelineMessage) error {
+	connArr, err := orm.OnlineMap.GetAll(clientId)
+	if err != nil {
+		return err
+	}
+	for _, ws := range connArr {
+		if e := ws.Send(onelineMessage); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 客户端确认消息
+func Ack(clientId, id string) {
+	for _, msg := range orm.InflightMap.Ack(clientId, id) {
+		Send(clientId, msg)
+	}
+}
+
+// 按订阅的 qos 发送消息
+func deliver(sub *orm.Subscriber, onelineMessage orm.OnelineMessage) {
+	if sub.Qos < onelineMessage.Qos {
+		onelineMessage.Qos = sub.Qos
+	}
+	onelineMessage.Retain = false
+	deliverTo(sub.ClientId, onelineMessage)
+}
+
+// 发送消息, 持久会话离线时保存到离线队列
+func deliverTo(clientId string, onelineMessage orm.OnelineMessage) {
+	onelineMessage.Dup = false
+	if orm.OnlineMap.Exist(clientId) != nil && orm.SessionMap.Persistent(clientId) {
+		if err := orm.SessionMap.Push(clientId, onelineMessage); err != nil {
+			log.Println("[session]", clientId, err.Error())
+		}
+		return
+	}
+	if inflight(clientId, onelineMessage) {
+		Send(clientId, onelineMessage)
+	}
+}
+
+// qos 1 的消息加入未确认窗口, 返回是否需要立即发送
+func inflight(clientId string, onelineMessage orm.OnelineMessage) bool {
+	if onelineMessage.Qos <= 0 {
+		return true
+	}
+	send, err := orm.InflightMap.Add(clientId, onelineMessage)
+	if err != nil {
+		log.Println("[qos]", err.Error())
+		return false
+	}
+	return send
+}
@@ -8,15 +8,11 @@ import (
 	"strconv"
 )
 
-var RedisAccount redisAccount
-
+// 每个请求使用独立的帐号对象, 并发请求不会写错帐号
 type redisAccount struct {
 	key string
 }
 
-func (r *redisAccount) SetKeyName(username string) {
-	r.key = username
-}
 func (r *redisAccount) Create(setMap map[string]string, expireTime int64) error {
 	if _, err := orm.Redis.HSetMap(r.key, setMap); err != nil {
 		return err
@@ -56,13 +52,14 @@ func (r *redisAccount) Delete() error {
 // @Tags                account redis
 // @Summary             获取redis帐号信息
 // @Produce             json
+// @Param 				Authorization 	header 	string 	true 	"Bearer 管理密钥"
 // @Param 				username 		path 	string 	true 	"帐号"
 // @Success             200 	{object} 	SuccessReturn
 // @Failure             400 	{object} 	FailReturn
 // @Router              /account/redis/{username} [get]
 func RedisGet(c *gin.Context) {
 	username := c.Param("username")
-	if username == "" {
+	if !orm.RedisAccountKey(username) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"code":    -1,
 			"message": "参数传递错误",
@@ -70,8 +67,8 @@ func RedisGet(c *gin.Context) {
 		return
 	}
 
-	RedisAccount.SetKeyName(username)
-	dataMap, err := RedisAccount.Get()
+	account := &redisAccount{key: username}
+	dataMap, err := account.Get()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    -1,
@@ -91,7 +88,8 @@ func RedisGet(c *gin.Context) {
 // @Tags                account redis
 // @Summary             创建redis帐号， 如果帐号存在，会清理帐号后创建
 // @Produce             json
-// @Param 				body 			body 	string 	true 	"json map[string]string { username:帐号, password:密钥, expire_time:过期时间(单位秒), key:value, ...  }"
+// @Param 				Authorization 	header 	string 	true 	"Bearer 管理密钥"
+// @Param 				body 			body 	string 	true 	"json map[string]string { username:帐号, password:密钥(按 PASSWORD_HASH 哈希保存), expire_time:过期时间(单位秒), key:value, ...  }"
 // @Success             200 	{object} 	SuccessReturn
 // @Failure             400 	{object} 	FailReturn
 // @Router              /account/redis [post]
@@ -112,14 +110,31 @@ func RedisCreate(c *gin.Context) {
 		})
 		return
 	}
+	if !orm.RedisAccountKey(username) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": "帐号不能包含:或使用保留的名称",
+		})
+		return
+	}
 
-	if _, ok := dataMap["password"]; !ok {
+	password, ok := dataMap["password"]
+	if !ok {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"code":    -1,
 			"message": "密钥为空",
 		})
 		return
 	}
+	hashed, err := orm.HashPassword(password)
+	if err != nil {
+		c.JSON(passwordStatus(err), gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+	dataMap["password"] = hashed
 
 	expire_time := int64(0)
 	if value, ok := dataMap["expire_time"]; ok {
@@ -129,8 +144,8 @@ func RedisCreate(c *gin.Context) {
 		delete(dataMap, "expire_time")
 	}
 
-	RedisAccount.SetKeyName(username)
-	flag, err := RedisAccount.Exists()
+	account := &redisAccount{key: username}
+	flag, err := account.Exists()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    -1,
@@ -139,7 +154,7 @@ func RedisCreate(c *gin.Context) {
 		return
 	}
 	if flag {
-		if err := RedisAccount.Delete(); err != nil {
+		if err := account.Delete(); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"code":    -1,
 				"message": err.Error(),
@@ -148,7 +163,7 @@ func RedisCreate(c *gin.Context) {
 		}
 	}
 
-	if err := RedisAccount.Create(dataMap, expire_time); err != nil {
+	if err := account.Create(dataMap, expire_time); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    -1,
 			"message": err.Error(),
@@ -166,14 +181,15 @@ func RedisCreate(c *gin.Context) {
 // @Tags                account redis
 // @Summary             更新redis帐号
 // @Produce             json
+// @Param 				Authorization 	header 	string 	true 	"Bearer 管理密钥"
 // @Param 				username 		path 	string 	true 	"帐号"
-// @Param 				body 			body 	body 	true 	"json map[string]string { password:密钥, expire_time:过期时间(单位秒), key:value, ...  }"
+// @Param 				body 			body 	body 	true 	"json map[string]string { password:密钥(按 PASSWORD_HASH 哈希保存), expire_time:过期时间(单位秒), key:value, ...  }"
 // @Success             200 	{object} 	SuccessReturn
 // @Failure             400 	{object} 	FailReturn
 // @Router              /account/redis/{username} [put]
 func RedisChange(c *gin.Context) {
 	username := c.Param("username")
-	if username == "" {
+	if !orm.RedisAccountKey(username) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"code":    -1,
 			"message": "参数传递错误",
@@ -181,7 +197,7 @@ func RedisChange(c *gin.Context) {
 		return
 	}
 
-	RedisAccount.SetKeyName(username)
+	account := &redisAccount{key: username}
 
 	var dataMap map[string]string
 	if err := c.ShouldBindJSON(&dataMap); err != nil {
@@ -199,8 +215,19 @@ func RedisChange(c *gin.Context) {
 		}
 		delete(dataMap, "expire_time")
 	}
+	if password, ok := dataMap["password"]; ok {
+		hashed, err := orm.HashPassword(password)
+		if err != nil {
+			c.JSON(passwordStatus(err), gin.H{
+				"code":    -1,
+				"message": err.Error(),
+			})
+			return
+		}
+		dataMap["password"] = hashed
+	}
 
-	flag, err := RedisAccount.Exists()
+	flag, err := account.Exists()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    -1,
@@ -217,7 +244,7 @@ func RedisChange(c *gin.Context) {
 	}
 
 	if len(dataMap) > 0 {
-		if err := RedisAccount.Set(dataMap); err != nil {
+		if err := account.Set(dataMap); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"code":    -1,
 				"message": err.Error(),
@@ -226,7 +253,7 @@ func RedisChange(c *gin.Context) {
 		}
 	}
 	if expire_time > 0 {
-		if err := RedisAccount.Expire(expire_time); err != nil {
+		if err := account.Expire(expire_time); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"code":    -1,
 				"message": err.Error(),
@@ -245,13 +272,14 @@ func RedisChange(c *gin.Context) {
 // @Tags                account redis
 // @Summary             删除redis帐号
 // @Produce             json
+// @Param 				Authorization 	header 	string 	true 	"Bearer 管理密钥"
 // @Param 				username 		path 	string 	true 	"帐号"
 // @Success             200 	{object} 	SuccessReturn
 // @Failure             400 	{object} 	FailReturn
 // @Router              /account/redis/{username} [delete]
 func RedisDelete(c *gin.Context) {
 	username := c.Param("username")
-	if username == "" {
+	if !orm.RedisAccountKey(username) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"code":    -1,
 			"message": "参数传递错误",
@@ -259,9 +287,9 @@ func RedisDelete(c *gin.Context) {
 		return
 	}
 
-	RedisAccount.SetKeyName(username)
+	account := &redisAccount{key: username}
 
-	flag, err := RedisAccount.Exists()
+	flag, err := account.Exists()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    -1,
@@ -277,7 +305,7 @@ func RedisDelete(c *gin.Context) {
 		return
 	}
 
-	if err := RedisAccount.Delete(); err != nil {
+	if err := account.Delete(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    -1,
 			"message": err.Error(),
@@ -291,3 +319,11 @@ func RedisDelete(c *gin.Context) {
 	})
 	return
 }
+
+// 提交的哈希不合法时返回 400
+func passwordStatus(err error) int {
+	if err == orm.ErrPasswordHash {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
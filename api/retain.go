@@ -0,0 +1,29 @@
+package api
+
+import (
+	"gmqtt/orm"
+	"log"
+)
+
+// 订阅成功后发送匹配的保留消息
+func SendRetain(onelineMessage orm.OnelineMessage) {
+	msgArr, err := orm.RetainMap.Match(onelineMessage.Topic)
+	if err != nil {
+		log.Println("[retain]", onelineMessage.Topic, err.Error())
+		return
+	}
+	qos := onelineMessage.Qos
+	if qos > 1 {
+		qos = 1
+	}
+	for _, msg := range msgArr {
+		if msg.ClientId != "*" && msg.ClientId != onelineMessage.ClientId {
+			continue
+		}
+		if msg.Qos > qos {
+			msg.Qos = qos
+		}
+		msg.Retain = true
+		deliverTo(onelineMessage.ClientId, msg)
+	}
+}
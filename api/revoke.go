@@ -0,0 +1,134 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"gmqtt/orm"
+	"log"
+	"net/http"
+	"time"
+)
+
+/*
+
+	wjt 撤销及在线连接检查
+		POST /admin/revoke		撤销 token 或用户的全部 token, 本节点立即断开, 其他节点在下次检查时断开
+	被撤销的连接发送关闭帧 4004 后断开, 过期的连接发送 4005
+
+*/
+
+type RevokeRequest struct {
+	Token     string `json:"token"`                    // 要撤销的 token, 不验证签名
+	TokenId   string `json:"tokenId" example:"1a2b3c"` // jti, 与 token 二选一
+	ExpiresAt int64  `json:"expiresAt"`                // jti 对应 token 的过期时间, 为 0 时按最长有效期保存
+	Subject   string `json:"subject" example:"1"`      // 撤销用户在此之前签发的全部 token
+}
+
+// 开启 wjt 验证时定时检查在线连接
+func RevokeRun() {
+	if !orm.AuthEnabled(orm.AuthWjt) {
+		return
+	}
+	interval := orm.Config.WJT.RevokeCheck
+	if interval <= 0 {
+		interval = 10
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			RevokeCheck()
+		}
+	}()
+}
+
+// 断开 token 过期或被撤销的连接, 返回断开的数量
+func RevokeCheck() int {
+	now := time.Now().Unix()
+	total := 0
+	orm.OnlineMap.Range(func(clientId string, conn *orm.Connection) bool {
+		identity := conn.Identity()
+		if identity == nil || identity.Method != orm.AuthWjt {
+			return true
+		}
+		if identity.ExpiresAt > 0 && identity.ExpiresAt <= now {
+			conn.CloseWithCode(orm.CloseCodeExpired, orm.CloseReasonTokenExpired)
+			total++
+			return true
+		}
+		err := orm.Revoke.Check(identity.TokenId, identity.UserId, identity.IssuedAt)
+		switch err {
+		case nil:
+		case orm.ErrTokenRevoked:
+			conn.CloseWithCode(orm.CloseCodeRevoked, orm.CloseReasonTokenRevoked)
+			total++
+		default:
+			log.Println("[revoke]", clientId, err.Error())
+		}
+		return true
+	})
+	return total
+}
+
+// @Tags                admin
+// @Summary             撤销 token, 已连接的客户端发送关闭帧 4004 后断开
+// @Produce             json
+// @Param 				Authorization 	header 	string 			true 	"Bearer 管理密钥"
+// @Param 				body 			body 	RevokeRequest 	true 	"token tokenId subject 至少一个"
+// @Success             200 	{object} 	SuccessReturn
+// @Failure             400 	{object} 	FailReturn
+// @Router              /admin/revoke [post]
+func TokenRevoke(c *gin.Context) {
+	var request RevokeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+	if request.Token != "" {
+		claims, err := orm.Token.GetPayload(request.Token)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    -1,
+				"message": err.Error(),
+			})
+			return
+		}
+		request.TokenId = claims.Id
+		request.ExpiresAt = claims.ExpiresAt
+	}
+	if request.TokenId == "" && request.Subject == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": "请指定token tokenId或subject",
+		})
+		return
+	}
+
+	if request.TokenId != "" {
+		if err := orm.Revoke.RevokeToken(request.TokenId, request.ExpiresAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"code":    -1,
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	if request.Subject != "" {
+		if err := orm.Revoke.RevokeSubject(request.Subject); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"code":    -1,
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1,
+		"message": "OK",
+		"data":    RevokeCheck(),
+	})
+	return
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gmqtt/orm"
+	"log"
+	"net/http"
+)
+
+/*
+
+	发送消息给指定客户端, 不需要订阅主题
+		客户端在本节点时直接发送, 在其他节点时通过节点队列转发
+		allow 时同一 clientId 可在多个节点在线, 发送给全部在线的节点
+		客户端离线但保留了持久会话时进入离线消息
+	节点队列中 action 为 takeover 时, 断开本节点该 clientId 的连接
+
+*/
+
+// 接收其他节点转发的消息
+func SubscribeNode() error {
+	return orm.MQ.SubscribeNode(orm.NodeMap.Name(), func(data string) {
+		var onelineMessage orm.OnelineMessage
+		if err := json.Unmarshal([]byte(data), &onelineMessage); err != nil {
+			return
+		}
+		if onelineMessage.Action == "takeover" {
+			// 客户端在其他节点重新连接
+			connArr, _ := orm.OnlineMap.GetAll(onelineMessage.ClientId)
+			for _, conn := range connArr {
+				conn.CloseWithCode(orm.CloseCodeTakeover, orm.CloseReasonTakeoverRemote)
+			}
+			return
+		}
+		sendLocal(onelineMessage)
+	})
+}
+
+// 发送给指定客户端, 返回消息id
+func SendTo(onelineMessage orm.OnelineMessage) (string, error) {
+	if onelineMessage.ClientId == "" || onelineMessage.ClientId == "*" {
+		return "", errors.New("请指定接收方clientId")
+	}
+	if err := orm.CheckTopicName(onelineMessage.Topic); err != nil {
+		return "", err
+	}
+	onelineMessage.Action = "send"
+	if onelineMessage.Id == "" {
+		onelineMessage.Id = orm.NewMessageId()
+	}
+	if onelineMessage.Qos > 1 {
+		onelineMessage.Qos = 1
+	}
+
+	nodeArr, err := orm.NodeMap.Nodes(onelineMessage.ClientId)
+	if err == orm.ErrClientOffline && orm.SessionMap.Persistent(onelineMessage.ClientId) {
+		nodeArr = []string{orm.NodeMap.Name()}
+	} else if err != nil {
+		return "", err
+	}
+
+	j, err := json.Marshal(onelineMessage)
+	if err != nil {
+		return "", err
+	}
+	// 部分节点转发失败时记录日志, 全部失败才返回错误
+	sent := false
+	for _, node := range nodeArr {
+		if node == orm.NodeMap.Name() {
+			sendLocal(onelineMessage)
+			sent = true
+			continue
+		}
+		if err = orm.MQ.PublishNode(node, string(j)); err != nil {
+			log.Println("[send]", onelineMessage.ClientId, node, err.Error())
+			continue
+		}
+		sent = true
+	}
+	if !sent {
+		return "", err
+	}
+	return onelineMessage.Id, nil
+}
+
+// 发送给本节点的客户端, 客户端收到的消息与订阅消息相同
+func sendLocal(onelineMessage orm.OnelineMessage) {
+	onelineMessage.Action = "publish"
+	onelineMessage.Retain = false
+	deliverTo(onelineMessage.ClientId, onelineMessage)
+}
+
+// @Tags                publish
+// @Summary             发送消息给指定客户端, 不需要订阅主题
+// @Produce             json
+// @Param 				Authorization 	header 	string 			true 	"Bearer 管理密钥"
+// @Param 				body 			body 	PublishRequest 	true 	"消息, clientId 必填"
+// @Success             200 	{object} 	PublishResult
+// @Failure             400 	{object} 	FailReturn
+// @Failure             404 	{object} 	FailReturn
+// @Router              /send [post]
+func HttpSend(c *gin.Context) {
+	var req PublishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+	if req.ClientId == "" || req.ClientId == "*" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": "请指定接收方clientId",
+		})
+		return
+	}
+	onelineMessage, err := req.onelineMessage()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	id, err := SendTo(onelineMessage)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == orm.ErrClientOffline {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1,
+		"message": "OK",
+		"data":    PublishResult{Id: id},
+	})
+	return
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"gmqtt/orm"
+	"log"
+	"time"
+)
+
+/*
+
+	持久会话 clean=false
+
+*/
+
+// 启动过期会话清理
+func SessionRun() {
+	orm.SessionMap.Init(orm.Config.Session)
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, clientId := range orm.SessionMap.Expired() {
+				orm.SubscribeMap.RemoveClient(clientId)
+			}
+		}
+	}()
+}
+
+// 恢复持久会话的订阅, 返回是否存在保存的订阅
+func SessionOpen(clientId string) (bool, error) {
+	subArr, err := orm.SessionMap.Open(clientId)
+	if err != nil {
+		return false, err
+	}
+	for _, sub := range subArr {
+		orm.SubscribeMap.Add(clientId, sub.Topic, sub.Qos)
+	}
+	return len(subArr) > 0, nil
+}
+
+// 接管旧连接时, 把内存中的订阅保存到持久会话, 返回是否存在订阅
+func SessionHandover(clientId string) bool {
+	subArr := orm.SubscribeMap.Subscribers(clientId)
+	for _, sub := range subArr {
+		if err := orm.SessionMap.Subscribe(clientId, sub.Topic, sub.Qos); err != nil {
+			log.Println("[session]", clientId, err.Error())
+		}
+	}
+	return len(subArr) > 0
+}
+
+// 取出离线消息, 返回需要按顺序发送的消息, qos 1 的消息加入未确认窗口
+func SessionReplay(clientId string) []orm.OnelineMessage {
+	msgArr, err := orm.SessionMap.Pop(clientId)
+	if err != nil {
+		log.Println("[session]", clientId, err.Error())
+	}
+	replayArr := make([]orm.OnelineMessage, 0, len(msgArr))
+	for _, msg := range msgArr {
+		if inflight(clientId, msg) {
+			replayArr = append(replayArr, msg)
+		}
+	}
+	return replayArr
+}
+
+// 持久会话离线, 未确认的消息保存到离线队列后保留会话
+func SessionClose(clientId string) {
+	for _, msg := range orm.InflightMap.Take(clientId) {
+		if err := orm.SessionMap.Push(clientId, msg); err != nil {
+			log.Println("[session]", clientId, err.Error())
+			break
+		}
+	}
+	orm.SessionMap.Close(clientId)
+}
+
+// 清理会话及订阅
+func SessionClean(clientId string) {
+	orm.SessionMap.Clean(clientId)
+	orm.SubscribeMap.RemoveClient(clientId)
+}
@@ -3,68 +3,72 @@ package api
 import (
 	"encoding/json"
 	"gmqtt/orm"
-	"reflect"
-	"sync"
+	"log"
 )
 
 func Subscribe() error {
-	orm.RabbitMQ.Subscribe(
-		orm.Config.RabbitMQ.Subscribe,
-		"channel",
+	return orm.MQ.Subscribe(
 		func(data string) {
 			var onelineMessage orm.OnelineMessage
 			if err := json.Unmarshal([]byte(data), &onelineMessage); err != nil {
 				return
 			}
-			cbMapTmp, ok := CallBackMap.Load(onelineMessage.Topic)
-			if !ok || cbMapTmp == nil {
+			if err := orm.CheckTopicName(onelineMessage.Topic); err != nil {
 				return
 			}
-			if reflect.TypeOf(cbMapTmp).String() != "map[string]orm.SubscribeCallback" {
-				return
-			}
-			cbMap := cbMapTmp.(map[string]orm.SubscribeCallback)
-			if onelineMessage.ClientId == "*" {
-				for _, cb := range cbMap {
-					cb(data)
-				}
-			} else {
-				if cb, ok := cbMap[onelineMessage.ClientId]; ok {
-					cb(data)
+			if onelineMessage.Retain {
+				if err := orm.RetainMap.Set(onelineMessage); err != nil {
+					log.Println("[retain]", onelineMessage.Topic, err.Error())
 				}
 			}
+			Dispatch(onelineMessage)
 		},
 	)
-	return orm.RabbitMQ.SubscribeRun()
 }
-func Publish(body string) error {
-	return orm.RabbitMQ.Publish(orm.Publish{
-		Name: orm.Config.RabbitMQ.Publish,
-		Kind: "channel",
-		Key:  "",
-		Body: body,
-	})
+
+// 发送消息到中间件, 返回消息id
+func Publish(onelineMessage orm.OnelineMessage) (string, error) {
+	if onelineMessage.Id == "" {
+		onelineMessage.Id = orm.NewMessageId()
+	}
+	if onelineMessage.Qos > 1 {
+		onelineMessage.Qos = 1
+	}
+	j, err := json.Marshal(onelineMessage)
+	if err != nil {
+		return "", err
+	}
+	return onelineMessage.Id, orm.MQ.Publish(string(j))
 }
 
-var CallBackMap sync.Map // map[topic] map[clientId]orm.SubscribeCallback
-func SubscribeAdd(onelineMessage orm.OnelineMessage, cb orm.SubscribeCallback) {
-	cbMapTmp, ok := CallBackMap.Load(onelineMessage.Topic)
-	cbMap := make(map[string]orm.SubscribeCallback)
-	if ok && reflect.TypeOf(cbMapTmp).String() == "map[string]orm.SubscribeCallback" {
-		cbMap = cbMapTmp.(map[string]orm.SubscribeCallback)
+// 分发消息给订阅者
+func Dispatch(onelineMessage orm.OnelineMessage) {
+	if onelineMessage.Qos > 0 && onelineMessage.Id == "" {
+		onelineMessage.Id = orm.NewMessageId()
+	}
+	subMap := orm.SubscribeMap.Match(onelineMessage.Topic)
+	if onelineMessage.ClientId == "*" {
+		for _, sub := range subMap {
+			deliver(sub, onelineMessage)
+		}
+	} else {
+		if sub, ok := subMap[onelineMessage.ClientId]; ok {
+			deliver(sub, onelineMessage)
+		}
 	}
-	cbMap[onelineMessage.ClientId] = cb
-	CallBackMap.Store(onelineMessage.Topic, cbMap)
 }
-func SubscribeDelete(onelineMessage orm.OnelineMessage) {
-	cbMapTmp, ok := CallBackMap.Load(onelineMessage.Topic)
-	if !ok {
-		return
+
+func SubscribeAdd(onelineMessage orm.OnelineMessage) error {
+	qos := onelineMessage.Qos
+	if qos > 1 {
+		qos = 1
 	}
-	if reflect.TypeOf(cbMapTmp).String() != "map[string]orm.SubscribeCallback" {
-		return
+	if err := orm.SubscribeMap.Add(onelineMessage.ClientId, onelineMessage.Topic, qos); err != nil {
+		return err
 	}
-	cbMap := cbMapTmp.(map[string]orm.SubscribeCallback)
-	delete(cbMap, onelineMessage.ClientId)
-	CallBackMap.Store(onelineMessage.Topic, cbMap)
+	return orm.SessionMap.Subscribe(onelineMessage.ClientId, onelineMessage.Topic, qos)
+}
+func SubscribeDelete(onelineMessage orm.OnelineMessage) {
+	orm.SubscribeMap.Remove(onelineMessage.ClientId, onelineMessage.Topic)
+	orm.SessionMap.Unsubscribe(onelineMessage.ClientId, onelineMessage.Topic)
 }
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"gmqtt/orm"
+	"log"
+	"strconv"
+)
+
+/*
+
+	遗嘱消息
+		连接时通过 willTopic willMessage willQos willRetain 参数, 或第一条 connect 消息的 will 设置
+		读取错误、心跳超时等异常断开时发布, 客户端发送 disconnect 主动断开时不发布
+
+*/
+
+// 读取连接参数中的遗嘱消息, 未设置返回 nil
+func WillQuery(c *gin.Context) (*orm.OnelineMessage, error) {
+	topic := c.Query("willTopic")
+	if topic == "" {
+		return nil, nil
+	}
+	will := &orm.OnelineMessage{
+		Topic:   topic,
+		Message: c.Query("willMessage"),
+	}
+	if qos, err := strconv.ParseInt(c.Query("willQos"), 10, 64); err == nil {
+		will.Qos = qos
+	}
+	if retain, err := strconv.ParseBool(c.Query("willRetain")); err == nil {
+		will.Retain = retain
+	}
+	if err := WillCheck(will); err != nil {
+		return nil, err
+	}
+	return will, nil
+}
+
+// 校验遗嘱消息
+func WillCheck(will *orm.OnelineMessage) error {
+	if orm.IsSysTopic(will.Topic) {
+		return errSysTopic
+	}
+	return orm.CheckTopicName(will.Topic)
+}
+
+// 发布遗嘱消息
+func WillPublish(clientId string, will *orm.OnelineMessage) {
+	msg := orm.OnelineMessage{
+		Action:   "publish",
+		ClientId: "*",
+		From:     clientId,
+		Topic:    will.Topic,
+		Message:  will.Message,
+		Qos:      will.Qos,
+		Retain:   will.Retain,
+	}
+	if _, err := Publish(msg); err != nil {
+		log.Println("[will]", clientId, err.Error())
+	}
+}
@@ -7,9 +7,34 @@ import (
 	"strconv"
 )
 
+/*
+
+	wjt 签发, 每个请求单独生成 claims
+		GET  /account/wjt/{id}		按 id 签发 access token, 需要管理密钥
+		POST /account/wjt			后台服务签发 access 及 refresh token, 需要管理密钥
+		POST /account/wjt/refresh	使用 refresh token 换取新的 token
+
+*/
+
+type WjtRequest struct {
+	Id       int64                  `json:"id" example:"1"`           // 唯一id
+	Subject  string                 `json:"subject" example:"1"`      // sub, 为空时使用 id
+	Username string                 `json:"username" example:"user"`  // 帐号
+	Roles    []string               `json:"roles" example:"dev"`      // 角色
+	Topics   []string               `json:"topics" example:"dev/#"`   // 允许发布及订阅的主题
+	Acl      []orm.AclRule          `json:"acl"`                      // 主题权限
+	Audience string                 `json:"audience" example:"gmqtt"` // aud, 为空时使用 WJT_AUDIENCE
+	Custom   map[string]interface{} `json:"custom"`                   // 自定义内容
+}
+
+type WjtRefreshRequest struct {
+	RefreshToken string `json:"refreshToken"` // refresh token
+}
+
 // @Tags                account wjt
 // @Summary             获取 web json token
 // @Produce             json
+// @Param 				Authorization 	header 	string 	true 	"Bearer 管理密钥"
 // @Param 				id 		path 	int 	true 	"唯一id"
 // @Success             200 	{object} 	SuccessReturn
 // @Failure             400 	{object} 	FailReturn
@@ -31,8 +56,7 @@ func WjtGet(c *gin.Context) {
 		return
 	}
 
-	orm.Token.Claims.ID = id
-	token, err := orm.Token.GenerateToken()
+	token, err := orm.Token.GenerateToken(orm.Claims{ID: id})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    -1,
@@ -48,3 +72,106 @@ func WjtGet(c *gin.Context) {
 	})
 	return
 }
+
+// @Tags                account wjt
+// @Summary             签发 access 及 refresh token
+// @Produce             json
+// @Param 				Authorization 	header 	string 		true 	"Bearer 管理密钥"
+// @Param 				body 			body 	WjtRequest 	true 	"token 内容"
+// @Success             200 	{object} 	orm.TokenPair
+// @Failure             400 	{object} 	FailReturn
+// @Router              /account/wjt [post]
+func WjtIssue(c *gin.Context) {
+	var request WjtRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+	if request.Id <= 0 && request.Subject == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": "请指定id或subject",
+		})
+		return
+	}
+	topics := request.Topics
+	for _, rule := range request.Acl {
+		topics = append(topics, rule.Topic)
+	}
+	for _, topic := range topics {
+		if err := orm.CheckTopicFilter(topic); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    -1,
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+
+	claims := orm.Claims{
+		ID:       request.Id,
+		Username: request.Username,
+		Roles:    request.Roles,
+		Topics:   request.Topics,
+		Acl:      request.Acl,
+		Custom:   request.Custom,
+	}
+	claims.Subject = request.Subject
+	if claims.Subject == "" {
+		claims.Subject = strconv.FormatInt(request.Id, 10)
+	}
+	claims.Audience = request.Audience
+
+	pair, err := orm.Token.Issue(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1,
+		"message": "OK",
+		"data":    pair,
+	})
+	return
+}
+
+// @Tags                account wjt
+// @Summary             使用 refresh token 换取新的 token
+// @Produce             json
+// @Param 				body 			body 	WjtRefreshRequest 	true 	"refresh token"
+// @Success             200 	{object} 	orm.TokenPair
+// @Failure             400 	{object} 	FailReturn
+// @Router              /account/wjt/refresh [post]
+func WjtRefresh(c *gin.Context) {
+	var request WjtRefreshRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	pair, err := orm.Token.Refresh(request.RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    -1,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    1,
+		"message": "OK",
+		"data":    pair,
+	})
+	return
+}
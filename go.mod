@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gin-gonic/gin v1.7.2
 	github.com/go-ini/ini v1.62.0
@@ -19,4 +20,5 @@ require (
 	github.com/swaggo/gin-swagger v1.3.0
 	github.com/swaggo/swag v1.7.0
 	github.com/timest/env v0.0.0-20180717050204-5fce78d35255 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
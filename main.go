@@ -15,28 +15,47 @@ func main() {
 		log.Fatalln("读取配置失败, 请设置 .env 文件, ", err.Error())
 	}
 
-	if err := orm.RabbitMQ.Init(orm.Config.RabbitMQ); err != nil {
-		log.Fatalln("RabbitMQ", err.Error())
+	switch orm.Config.Broker {
+	case orm.BrokerRedis:
+		if err := orm.Redis.Connect(orm.Config.Redis); err != nil {
+			log.Fatalln("redis ", err.Error())
+		}
+		orm.MQ = &orm.RedisBroker{Redis: &orm.Redis, Conf: orm.Config.Redis}
+	case orm.BrokerMemory:
+		orm.MQ = orm.NewMemoryBroker()
+	default:
+		if err := orm.RabbitMQ.Init(orm.Config.RabbitMQ); err != nil {
+			log.Fatalln("RabbitMQ", err.Error())
+		}
+		orm.MQ = &orm.RabbitBroker{Rabbit: &orm.RabbitMQ, Conf: orm.Config.RabbitMQ}
 	}
+	orm.NodeMap.Init(orm.Config.Node, orm.Config.Presence)
 	if err := api.Subscribe(); err != nil {
-		log.Fatalln("RabbitMQ", "subscribe", err.Error())
+		log.Fatalln("broker", orm.Config.Broker, "subscribe", err.Error())
 	}
+	if err := api.SubscribeNode(); err != nil {
+		log.Fatalln("broker", orm.Config.Broker, "subscribe node", orm.Config.Node, err.Error())
+	}
+	api.QosRun()
+	api.SessionRun()
+
+	if err := orm.InitAuth(orm.Config.Auth); err != nil {
+		log.Fatalln("auth", orm.Config.Auth, err.Error())
+	}
+	orm.AclMap.Init(orm.Config.Acl)
+	api.RevokeRun()
 
-	switch orm.Config.Auth {
-	case "redis":
+	// 持久会话等功能依赖 redis, 配置了 redis 时尝试连接
+	if !orm.Redis.IsConnected() && orm.Config.Redis.Host != "" {
 		if err := orm.Redis.Connect(orm.Config.Redis); err != nil {
-			log.Fatalln("redis ", err.Error())
-		}
-	case "mysql":
-		if err := orm.MySql.Connect(orm.Config.MySQL); err != nil {
-			log.Fatalln("MySql ", err.Error())
+			log.Println("redis ", err.Error())
 		}
-	case "wjt":
-		orm.Token.Init(orm.Config.WJT)
-	default:
-		//开放权限
 	}
 
+	// 集群在线记录
+	orm.NodeMap.Run()
+	orm.Webhook.Init(orm.Config.Webhook)
+
 	//进程停止时候运行
 	ch := make(chan os.Signal, 1)
 	signal.Notify(
@@ -51,13 +70,27 @@ func main() {
 		s := <-ch
 		log.Println("[gin] 停止服务", s)
 
+		orm.NodeMap.Close()
+		orm.Webhook.Close()
+		orm.MQ.Close()
 		orm.Redis.Close()
-		orm.RabbitMQ.Close()
 		orm.MySql.Close()
 
 		os.Exit(1)
 	}()
 
+	// mqtt tcp 及 tls 服务, 与 websocket 共用在线列表及消息分发
+	go func() {
+		if err := router.MqttStart(orm.Config.Mqtt); err != nil {
+			log.Fatalln("mqtt tcp ", err.Error())
+		}
+	}()
+	go func() {
+		if err := router.MqttTlsStart(orm.Config.Mqtt); err != nil {
+			log.Fatalln("mqtt tls ", err.Error())
+		}
+	}()
+
 	router.HttpStart()
 	return
 }
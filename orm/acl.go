@@ -0,0 +1,251 @@
+package orm
+
+import (
+	"errors"
+	"strings"
+)
+
+/*
+
+	主题权限, 按验证通过的方式在连接时加载, 修改规则后客户端重新连接生效
+		redis	帐号 hash 的 roles 字段为角色, 逗号分隔, /account/redis 需要管理密钥才能修改
+				规则 hash acl:client:{clientId} acl:user:{username} acl:role:{role}
+				字段为主题, 值为 动作:allow|deny, 多个用逗号分隔, 如 publish:deny,subscribe:allow
+		mysql	MYSQL_AUTH_FIELD_ROLE 字段为角色, MYSQL_ACL_TABLE 表为规则
+				表字段 username client_id role topic action allow, 为空的字段匹配全部
+		wjt		token 中的 roles acl, topics 为允许发布及订阅的主题
+		其他		不限制
+
+	动作 publish subscribe all, 主题支持通配符及 %u(帐号) %c(clientId) 占位符
+	帐号或 clientId 包含 + # / 时不能使用占位符, 有规则使用时拒绝连接
+	匹配到 deny 时拒绝, 否则匹配到 allow 时允许, 都没有匹配时按 ACL_DEFAULT 处理
+	订阅时 allow 规则需包含整个订阅主题, deny 规则与订阅主题有交集即拒绝
+
+*/
+
+const (
+	AclPublish   = "publish"
+	AclSubscribe = "subscribe"
+	AclAll       = "all"
+
+	AclAllow = "allow"
+	AclDeny  = "deny"
+)
+
+var AclMap Acl
+
+var ErrAclDeny = errors.New("没有该主题的权限")
+var ErrAclPlaceholder = errors.New("帐号或clientId包含 + # /, 不能用于主题权限")
+
+type AclConf struct {
+	Default string `env:"ACL_DEFAULT"` // 没有匹配规则时 allow deny, 默认 allow
+}
+
+// 权限规则, Username ClientId Role 为空时匹配全部
+type AclRule struct {
+	Username string `json:"username,omitempty" gorm:"column:username"`
+	ClientId string `json:"clientId,omitempty" gorm:"column:client_id"`
+	Role     string `json:"role,omitempty" gorm:"column:role"`
+	Topic    string `json:"topic" gorm:"column:topic"`
+	Action   string `json:"action" gorm:"column:action"` // publish subscribe all
+	Allow    bool   `json:"allow" gorm:"column:allow"`
+}
+
+type Acl struct {
+	conf AclConf
+}
+
+// 单个连接的权限
+type AclList struct {
+	username string
+	clientId string
+	deny     bool // 没有匹配规则时拒绝
+	rules    []AclRule
+}
+
+func (obj *Acl) Init(conf AclConf) {
+	obj.conf = conf
+}
+
+// 加载连接的权限规则, 按验证方式读取
+func (obj *Acl) Load(identity *Identity, clientId string) (*AclList, error) {
+	list := &AclList{
+		clientId: clientId,
+		deny:     obj.conf.Default == AclDeny,
+	}
+	if identity == nil {
+		// 未验证, 不限制
+		list.deny = false
+		return list, nil
+	}
+	list.username = identity.Username
+
+	var rules []AclRule
+	var err error
+	switch identity.Method {
+	case AuthRedis:
+		rules, err = obj.loadRedis(identity, clientId)
+	case AuthMySql:
+		rules, err = MySql.AclRules(identity.Username, clientId, identity.Roles)
+	case AuthWjt:
+		rules = identity.Acl
+	default:
+		// 不限制
+		list.deny = false
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	roleMap := make(map[string]bool)
+	for _, role := range identity.Roles {
+		roleMap[role] = true
+	}
+	for _, rule := range rules {
+		if rule.Username != "" && rule.Username != list.username {
+			continue
+		}
+		if rule.ClientId != "" && rule.ClientId != clientId {
+			continue
+		}
+		if rule.Role != "" && !roleMap[rule.Role] {
+			continue
+		}
+		// 占位符替换为通配符会扩大权限
+		if (strings.Contains(rule.Topic, "%u") && !aclPlaceholderValid(list.username)) ||
+			(strings.Contains(rule.Topic, "%c") && !aclPlaceholderValid(clientId)) {
+			return nil, ErrAclPlaceholder
+		}
+		rule.Topic = strings.NewReplacer("%u", list.username, "%c", clientId).Replace(rule.Topic)
+		list.rules = append(list.rules, rule)
+	}
+	return list, nil
+}
+
+// 占位符的值不能包含通配符及分隔符
+func aclPlaceholderValid(value string) bool {
+	return !strings.ContainsAny(value, topicSingleLevel+topicMultiLevel+topicSeparator)
+}
+
+func (obj *Acl) loadRedis(identity *Identity, clientId string) ([]AclRule, error) {
+	var rules []AclRule
+	keys := []string{"acl:client:" + clientId, "acl:user:" + identity.Username}
+	for _, role := range identity.Roles {
+		keys = append(keys, "acl:role:"+role)
+	}
+	for _, key := range keys {
+		dataMap, err := Redis.HGetAll(key)
+		if err != nil {
+			return nil, err
+		}
+		for topic, value := range dataMap {
+			rules = append(rules, parseAclValue(topic, value)...)
+		}
+	}
+	return rules, nil
+}
+
+// 解析 redis 中的规则, publish:deny,subscribe:allow
+func parseAclValue(topic, value string) []AclRule {
+	var rules []AclRule
+	for _, item := range splitList(value) {
+		action, permission := AclAll, item
+		if i := strings.Index(item, ":"); i >= 0 {
+			action, permission = item[:i], item[i+1:]
+		}
+		rules = append(rules, AclRule{
+			Topic:  topic,
+			Action: action,
+			Allow:  permission == AclAllow,
+		})
+	}
+	return rules
+}
+
+// 检查主题权限, 订阅时 topic 为订阅主题
+func (l *AclList) Check(action, topic string) error {
+	if l == nil {
+		return nil
+	}
+	allow := false
+	for _, rule := range l.rules {
+		if rule.Action != action && rule.Action != AclAll {
+			continue
+		}
+		var match bool
+		switch {
+		case action == AclPublish:
+			match = TopicMatch(rule.Topic, topic)
+		case rule.Allow:
+			match = topicCover(rule.Topic, topic)
+		default:
+			match = topicOverlap(rule.Topic, topic)
+		}
+		if !match {
+			continue
+		}
+		if !rule.Allow {
+			return ErrAclDeny
+		}
+		allow = true
+	}
+	if allow || !l.deny {
+		return nil
+	}
+	return ErrAclDeny
+}
+
+// 订阅主题 filter 匹配的主题都被 pattern 匹配
+func topicCover(pattern, filter string) bool {
+	patternLevels := strings.Split(pattern, topicSeparator)
+	filterLevels := strings.Split(filter, topicSeparator)
+	for i, level := range patternLevels {
+		if i == 0 && strings.HasPrefix(filter, "$") &&
+			(level == topicSingleLevel || level == topicMultiLevel) {
+			return false
+		}
+		if level == topicMultiLevel {
+			return true
+		}
+		if i >= len(filterLevels) || filterLevels[i] == topicMultiLevel {
+			return false
+		}
+		if level != topicSingleLevel && (level != filterLevels[i] || filterLevels[i] == topicSingleLevel) {
+			return false
+		}
+	}
+	return len(patternLevels) == len(filterLevels)
+}
+
+// 两个订阅主题是否存在同时匹配的主题
+func topicOverlap(a, b string) bool {
+	aLevels := strings.Split(a, topicSeparator)
+	bLevels := strings.Split(b, topicSeparator)
+	if strings.HasPrefix(a, "$") != strings.HasPrefix(b, "$") {
+		// $ 开头的主题不被首层通配符匹配
+		return false
+	}
+	for i := 0; i < len(aLevels) && i < len(bLevels); i++ {
+		if aLevels[i] == topicMultiLevel || bLevels[i] == topicMultiLevel {
+			return true
+		}
+		if aLevels[i] == topicSingleLevel || bLevels[i] == topicSingleLevel {
+			continue
+		}
+		if aLevels[i] != bLevels[i] {
+			return false
+		}
+	}
+	if len(aLevels) == len(bLevels) {
+		return true
+	}
+	// sensors/# 同时匹配 sensors
+	if len(aLevels) == len(bLevels)+1 {
+		return aLevels[len(aLevels)-1] == topicMultiLevel
+	}
+	if len(bLevels) == len(aLevels)+1 {
+		return bLevels[len(bLevels)-1] == topicMultiLevel
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package orm
+
+import (
+	"testing"
+)
+
+func TestAclPlaceholder(t *testing.T) {
+	acl := Acl{conf: AclConf{Default: AclDeny}}
+	rules := []AclRule{
+		{Topic: "devices/%c/#", Action: AclAll, Allow: true},
+		{Topic: "users/%u/inbox", Action: AclSubscribe, Allow: true},
+	}
+	tests := []struct {
+		name     string
+		username string
+		clientId string
+		err      error
+	}{
+		{"normal", "bob", "d1", nil},
+		{"clientId #", "bob", "#", ErrAclPlaceholder},
+		{"clientId +", "bob", "+", ErrAclPlaceholder},
+		{"clientId /", "bob", "a/b", ErrAclPlaceholder},
+		{"username #", "#", "d1", ErrAclPlaceholder},
+		{"username +", "a+b", "d1", ErrAclPlaceholder},
+	}
+	for _, tt := range tests {
+		identity := &Identity{Method: AuthWjt, Username: tt.username, Acl: rules}
+		list, err := acl.Load(identity, tt.clientId)
+		if err != tt.err {
+			t.Errorf("%s: Load err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if err := list.Check(AclPublish, "devices/other/cmd"); err != ErrAclDeny {
+			t.Errorf("%s: publish devices/other/cmd err = %v, want deny", tt.name, err)
+		}
+		if err := list.Check(AclSubscribe, "devices/#"); err != ErrAclDeny {
+			t.Errorf("%s: subscribe devices/# err = %v, want deny", tt.name, err)
+		}
+		if err := list.Check(AclPublish, "devices/"+tt.clientId+"/cmd"); err != nil {
+			t.Errorf("%s: publish own topic err = %v", tt.name, err)
+		}
+	}
+
+	// 没有使用占位符的规则不受影响
+	identity := &Identity{Method: AuthWjt, Username: "bob", Acl: []AclRule{{Topic: "a/#", Action: AclAll, Allow: true}}}
+	if _, err := acl.Load(identity, "#"); err != nil {
+		t.Errorf("rule without placeholder: Load err = %v", err)
+	}
+}
+
+func TestAclCheck(t *testing.T) {
+	list := &AclList{
+		deny: true,
+		rules: []AclRule{
+			{Topic: "a/#", Action: AclAll, Allow: true},
+			{Topic: "a/secret/#", Action: AclAll, Allow: false},
+			{Topic: "b/+/temp", Action: AclSubscribe, Allow: true},
+			{Topic: "$SYS/#", Action: AclSubscribe, Allow: true},
+		},
+	}
+	tests := []struct {
+		action string
+		topic  string
+		allow  bool
+	}{
+		{AclPublish, "a/1", true},
+		{AclPublish, "a", true},
+		{AclPublish, "a/secret/x", false},
+		{AclPublish, "b/1/temp", false},
+		{AclSubscribe, "a/+", false}, // 与 a/secret/# 有交集
+		{AclSubscribe, "a/1/#", true},
+		{AclSubscribe, "a/secret", false},
+		{AclSubscribe, "b/1/temp", true},
+		{AclSubscribe, "b/+/temp", true},
+		{AclSubscribe, "b/#", false},
+		{AclSubscribe, "#", false},
+		{AclSubscribe, "$SYS/broker/clients", true},
+		{AclPublish, "c", false},
+	}
+	for _, tt := range tests {
+		err := list.Check(tt.action, tt.topic)
+		if (err == nil) != tt.allow {
+			t.Errorf("Check(%s, %s) = %v, want allow %v", tt.action, tt.topic, err, tt.allow)
+		}
+	}
+
+	var empty *AclList
+	if err := empty.Check(AclPublish, "x"); err != nil {
+		t.Errorf("nil list Check = %v", err)
+	}
+}
+
+func TestTopicCover(t *testing.T) {
+	tests := []struct {
+		pattern string
+		filter  string
+		want    bool
+	}{
+		{"a/#", "a/b", true},
+		{"a/#", "a/#", true},
+		{"a/#", "a", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/+", true},
+		{"a/+", "a/#", false},
+		{"a/b", "a/+", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/b", "a/b/c", false},
+		{"#", "a/b", true},
+		{"#", "$SYS/a", false},
+		{"+/a", "$SYS/a", false},
+		{"$SYS/#", "$SYS/a", true},
+	}
+	for _, tt := range tests {
+		if got := topicCover(tt.pattern, tt.filter); got != tt.want {
+			t.Errorf("topicCover(%q, %q) = %v, want %v", tt.pattern, tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestTopicOverlap(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "+/b", true},
+		{"a/#", "a", true},
+		{"a", "a/#", true},
+		{"a/#", "b/#", false},
+		{"#", "a/b/c", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/#", true},
+		{"#", "$SYS/a", false},
+		{"$SYS/+", "$SYS/#", true},
+	}
+	for _, tt := range tests {
+		if got := topicOverlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("topicOverlap(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package orm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+/*
+
+	帐号验证, HOST_AUTH, 多个用逗号分隔时依次验证, 如 wjt,redis 先验证 token 再验证 redis 帐号
+		redis	redis hash 中的 password 字段
+		mysql	MYSQL_AUTH_TABLE 表中的帐号密码, 查询及缓存见 mysql.go
+				密码支持 bcrypt argon2 pbkdf2 哈希, 见 password.go
+		wjt		token, 或 username password 为 token
+		open	开放权限, 为空时默认
+
+	验证通过返回 Identity, 在 gin 上下文中保存为 identity
+
+*/
+
+const (
+	AuthRedis = "redis"
+	AuthMySql = "mysql"
+	AuthWjt   = "wjt"
+	AuthOpen  = "open"
+
+	IdentityKey = "identity" // gin 上下文中的验证结果
+)
+
+var Auth Authenticator = &OpenAuth{}
+
+type AuthError struct {
+	Status int // http 状态码
+	Err    error
+}
+
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
+
+func authError(status int, err error) *AuthError {
+	return &AuthError{
+		Status: status,
+		Err:    err,
+	}
+}
+
+// 验证参数
+type Credentials struct {
+	Username string
+	Password string
+	Token    string // Bearer 或子协议中的 token
+	ClientId string
+}
+
+// 验证结果
+type Identity struct {
+	Method   string                 `json:"method"` // 验证方式
+	UserId   string                 `json:"userId"`
+	Username string                 `json:"username"`
+	Roles    []string               `json:"roles,omitempty"`
+	Claims   map[string]interface{} `json:"claims,omitempty"` // token 内容或帐号的其他字段
+	Acl      []AclRule              `json:"acl,omitempty"`    // token 中的主题权限
+
+	// wjt 验证时 token 的 jti 签发及过期时间, 用于撤销及过期断开
+	TokenId   string `json:"tokenId,omitempty"`
+	IssuedAt  int64  `json:"issuedAt,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, credentials Credentials) (*Identity, error)
+}
+
+// 按 HOST_AUTH 初始化验证方式, 连接验证所需的 redis mysql
+func InitAuth(methods string) error {
+	var chain AuthChain
+	for _, name := range splitList(methods) {
+		auth, err := NewAuthenticator(name)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, auth)
+	}
+	switch len(chain) {
+	case 0:
+		Auth = &OpenAuth{}
+	case 1:
+		Auth = chain[0]
+	default:
+		Auth = chain
+	}
+	return nil
+}
+
+func NewAuthenticator(name string) (Authenticator, error) {
+	switch name {
+	case AuthRedis:
+		if !Redis.IsConnected() {
+			if err := Redis.Connect(Config.Redis); err != nil {
+				return nil, err
+			}
+		}
+		return &RedisAuth{}, nil
+	case AuthMySql:
+		if MySql.Conn == nil {
+			if err := MySql.Connect(Config.MySQL); err != nil {
+				return nil, err
+			}
+		}
+		return &MySqlAuth{}, nil
+	case AuthWjt:
+		if err := Token.Init(Config.WJT); err != nil {
+			return nil, err
+		}
+		return &WjtAuth{}, nil
+	case AuthOpen:
+		return &OpenAuth{}, nil
+	}
+	return nil, errors.New("验证方式错误#" + name)
+}
+
+// 是否开启了验证方式
+func AuthEnabled(name string) bool {
+	for _, item := range splitList(Config.Auth) {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 依次验证, 全部失败时返回最后一个错误
+type AuthChain []Authenticator
+
+func (chain AuthChain) Authenticate(ctx context.Context, credentials Credentials) (*Identity, error) {
+	err := authError(http.StatusBadRequest, errors.New("参数传递错误"))
+	for _, auth := range chain {
+		identity, authErr := auth.Authenticate(ctx, credentials)
+		if authErr == nil {
+			return identity, nil
+		}
+		err = toAuthError(authErr)
+	}
+	return nil, err
+}
+
+func toAuthError(err error) *AuthError {
+	if authErr, ok := err.(*AuthError); ok {
+		return authErr
+	}
+	return authError(http.StatusBadRequest, err)
+}
+
+// redis 帐号可以使用的 key, 不能包含 : 及服务使用的 key, 避免修改撤销记录 主题权限 会话等
+func RedisAccountKey(username string) bool {
+	if username == "" || strings.Contains(username, ":") {
+		return false
+	}
+	return username != retainKey && username != presenceKey
+}
+
+// redis hash 中的 password 字段, 其他字段作为 Claims, roles 字段为角色
+type RedisAuth struct{}
+
+func (a *RedisAuth) Authenticate(ctx context.Context, credentials Credentials) (*Identity, error) {
+	if !RedisAccountKey(credentials.Username) {
+		return nil, authError(http.StatusBadRequest, errors.New("参数传递错误"))
+	}
+
+	dataMap, err := Redis.HGetAll(credentials.Username)
+	if err != nil {
+		return nil, authError(http.StatusInternalServerError, err)
+	}
+	if len(dataMap) == 0 {
+		return nil, authError(http.StatusGone, errors.New("帐号不存在"))
+	}
+	if password, ok := dataMap["password"]; !ok || !CheckPassword(credentials.Password, password) {
+		return nil, authError(http.StatusBadRequest, errors.New("password is wrong"))
+	}
+
+	identity := &Identity{
+		Method:   AuthRedis,
+		UserId:   credentials.Username,
+		Username: credentials.Username,
+		Roles:    splitList(dataMap["roles"]),
+		Claims:   make(map[string]interface{}),
+	}
+	if id, ok := dataMap["id"]; ok && id != "" {
+		identity.UserId = id
+	}
+	for key, value := range dataMap {
+		if key != "password" {
+			identity.Claims[key] = value
+		}
+	}
+	return identity, nil
+}
+
+// MYSQL_AUTH_TABLE 表中的帐号密码
+type MySqlAuth struct{}
+
+func (a *MySqlAuth) Authenticate(ctx context.Context, credentials Credentials) (*Identity, error) {
+	if credentials.Username == "" {
+		return nil, authError(http.StatusBadRequest, errors.New("参数传递错误"))
+	}
+	user, err := MySql.User(credentials.Username)
+	if err != nil {
+		return nil, authError(http.StatusInternalServerError, err)
+	}
+	if user == nil {
+		return nil, authError(http.StatusGone, errors.New("帐号不存在"))
+	}
+	if !MySql.CheckUser(user, credentials.Password) {
+		return nil, authError(http.StatusBadRequest, errors.New("password is wrong"))
+	}
+
+	identity := &Identity{
+		Method:   AuthMySql,
+		UserId:   credentials.Username,
+		Username: credentials.Username,
+		Roles:    user.Roles,
+	}
+	if user.Id != "" {
+		identity.UserId = user.Id
+	}
+	return identity, nil
+}
+
+// token, 或 username password 为 token, refresh token 不能用于验证
+// UserId 为 token 的 sub, 为空时使用 ID, 帐号为 token 的 username, 为空时使用 UserId
+type WjtAuth struct{}
+
+func (a *WjtAuth) Authenticate(ctx context.Context, credentials Credentials) (*Identity, error) {
+	err := errors.New("参数传递错误")
+	for _, token := range []string{credentials.Token, credentials.Username, credentials.Password} {
+		if token == "" {
+			continue
+		}
+		var claims *Claims
+		if claims, err = Token.ParseToken(token); err != nil {
+			continue
+		}
+		if claims.Type == TokenRefresh {
+			err = errors.New("refresh token不能用于验证")
+			continue
+		}
+		if err := Revoke.Check(claims.Id, claims.UserId(), claims.IssuedAt); err != nil {
+			return nil, authError(http.StatusUnauthorized, err)
+		}
+
+		identity := &Identity{
+			Method:    AuthWjt,
+			UserId:    claims.UserId(),
+			Username:  claims.Username,
+			Roles:     claims.Roles,
+			Acl:       claims.Acl,
+			TokenId:   claims.Id,
+			IssuedAt:  claims.IssuedAt,
+			ExpiresAt: claims.ExpiresAt,
+		}
+		if identity.Username == "" {
+			identity.Username = identity.UserId
+		}
+		for _, topic := range claims.Topics {
+			identity.Acl = append(identity.Acl, AclRule{
+				Topic:  topic,
+				Action: AclAll,
+				Allow:  true,
+			})
+		}
+		if j, err := json.Marshal(claims); err == nil {
+			json.Unmarshal(j, &identity.Claims)
+		}
+		return identity, nil
+	}
+	return nil, authError(http.StatusBadRequest, err)
+}
+
+// 开放权限
+type OpenAuth struct{}
+
+func (a *OpenAuth) Authenticate(ctx context.Context, credentials Credentials) (*Identity, error) {
+	return &Identity{
+		Method:   AuthOpen,
+		UserId:   credentials.Username,
+		Username: credentials.Username,
+	}, nil
+}
@@ -0,0 +1,26 @@
+package orm
+
+import (
+	"testing"
+)
+
+func TestRedisAccountKey(t *testing.T) {
+	tests := []struct {
+		username string
+		want     bool
+	}{
+		{"bob", true},
+		{"bob@example.com", true},
+		{"", false},
+		{"revoke:sub:1", false},
+		{"acl:user:bob", false},
+		{"session:c1", false},
+		{retainKey, false},
+		{presenceKey, false},
+	}
+	for _, tt := range tests {
+		if got := RedisAccountKey(tt.username); got != tt.want {
+			t.Errorf("RedisAccountKey(%q) = %v, want %v", tt.username, got, tt.want)
+		}
+	}
+}
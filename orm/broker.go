@@ -0,0 +1,220 @@
+package orm
+
+import (
+	"errors"
+	"sync"
+)
+
+/*
+
+	消息中间件
+		rabbitmq	默认, 使用 RABBITMQ_PUBLISH_TOPIC / RABBITMQ_SUBSCRIBE_TOPIC 队列
+		redis		使用 redis 发布订阅, REDIS_PUBLISH_CHANNEL / REDIS_SUBSCRIBE_CHANNEL
+		memory		进程内转发, 单节点或测试使用, 不依赖外部服务
+	节点队列
+		每个节点订阅 {订阅队列}.{HOST_NODE}, 发送给指定客户端的消息转发到客户端所在节点
+
+*/
+
+const (
+	BrokerRabbitMQ = "rabbitmq"
+	BrokerRedis    = "redis"
+	BrokerMemory   = "memory"
+
+	memoryQueueSize = 1000 // 内存队列长度
+)
+
+var MQ Broker
+
+type Broker interface {
+	Publish(body string) error                             // 发送消息
+	Subscribe(cb SubscribeCallback) error                  // 接收消息
+	PublishNode(node, body string) error                   // 发送消息到指定节点
+	SubscribeNode(node string, cb SubscribeCallback) error // 接收本节点的消息
+	Close()                                                // 关闭
+	Health() error                                         // 服务状态
+}
+
+// 节点队列名称
+func nodeQueue(name, node string) string {
+	return name + "." + node
+}
+
+/*
+	rabbitMQ
+*/
+
+type RabbitBroker struct {
+	Rabbit *Rabbit
+	Conf   RabbitMQConf
+}
+
+func (b *RabbitBroker) Publish(body string) error {
+	return b.Rabbit.Publish(Publish{
+		Name: b.Conf.Publish,
+		Kind: "channel",
+		Key:  "",
+		Body: body,
+	})
+}
+func (b *RabbitBroker) Subscribe(cb SubscribeCallback) error {
+	b.Rabbit.Subscribe(b.Conf.Subscribe, "channel", cb)
+	return b.Rabbit.SubscribeRun()
+}
+func (b *RabbitBroker) PublishNode(node, body string) error {
+	return b.Rabbit.Publish(Publish{
+		Name: nodeQueue(b.Conf.Subscribe, node),
+		Kind: "channel",
+		Key:  "",
+		Body: body,
+	})
+}
+func (b *RabbitBroker) SubscribeNode(node string, cb SubscribeCallback) error {
+	// 保存订阅, 重连后重新执行
+	name := nodeQueue(b.Conf.Subscribe, node)
+	b.Rabbit.Subscribe(name, "channel", cb)
+	if err := b.Rabbit.wait(); err != nil {
+		return err
+	}
+	return b.Rabbit.SubscribeAction(SubScribe{
+		Name:     name,
+		Kind:     "channel",
+		Keys:     []string{""},
+		Callback: cb,
+	})
+}
+func (b *RabbitBroker) Close() {
+	b.Rabbit.Close()
+}
+func (b *RabbitBroker) Health() error {
+	if !b.Rabbit.isConnected {
+		return errors.New("rabbitMQ未连接")
+	}
+	return nil
+}
+
+/*
+	redis 发布订阅
+*/
+
+type RedisBroker struct {
+	Redis *RedisConn
+	Conf  RedisConf
+}
+
+func (b *RedisBroker) Publish(body string) error {
+	return b.Redis.PublicMsg(b.Conf.Publish, body)
+}
+func (b *RedisBroker) Subscribe(cb SubscribeCallback) error {
+	if err := b.Redis.SubInit(); err != nil {
+		return err
+	}
+	return b.Redis.Subscribe(b.Conf.Subscribe, cb)
+}
+func (b *RedisBroker) PublishNode(node, body string) error {
+	return b.Redis.PublicMsg(nodeQueue(b.Conf.Subscribe, node), body)
+}
+func (b *RedisBroker) SubscribeNode(node string, cb SubscribeCallback) error {
+	if err := b.Redis.SubInit(); err != nil {
+		return err
+	}
+	return b.Redis.Subscribe(nodeQueue(b.Conf.Subscribe, node), cb)
+}
+func (b *RedisBroker) Close() {
+	b.Redis.Close()
+}
+func (b *RedisBroker) Health() error {
+	return b.Redis.Status()
+}
+
+/*
+	内存
+*/
+
+type MemoryBroker struct {
+	queue  chan memoryMessage
+	done   chan bool
+	once   sync.Once
+	mutex  sync.Mutex
+	cbArr  []SubscribeCallback
+	nodeCb map[string]SubscribeCallback // map[node]
+}
+
+type memoryMessage struct {
+	node string // 为空时发送给全部订阅
+	body string
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		queue:  make(chan memoryMessage, memoryQueueSize),
+		done:   make(chan bool),
+		nodeCb: make(map[string]SubscribeCallback),
+	}
+	go b.loop()
+	return b
+}
+func (b *MemoryBroker) loop() {
+	for {
+		select {
+		case msg := <-b.queue:
+			b.mutex.Lock()
+			cbArr := b.cbArr
+			if msg.node != "" {
+				cbArr = nil
+				if cb, ok := b.nodeCb[msg.node]; ok {
+					cbArr = []SubscribeCallback{cb}
+				}
+			}
+			b.mutex.Unlock()
+			for _, cb := range cbArr {
+				cb(msg.body)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+func (b *MemoryBroker) Publish(body string) error {
+	return b.push(memoryMessage{body: body})
+}
+func (b *MemoryBroker) PublishNode(node, body string) error {
+	return b.push(memoryMessage{node: node, body: body})
+}
+func (b *MemoryBroker) push(msg memoryMessage) error {
+	// 队列未满时 select 可能选中发送, 先检查是否已关闭
+	if err := b.Health(); err != nil {
+		return err
+	}
+	select {
+	case b.queue <- msg:
+		return nil
+	case <-b.done:
+		return errors.New("broker已关闭")
+	}
+}
+func (b *MemoryBroker) SubscribeNode(node string, cb SubscribeCallback) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.nodeCb[node] = cb
+	return nil
+}
+func (b *MemoryBroker) Subscribe(cb SubscribeCallback) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.cbArr = append(b.cbArr, cb)
+	return nil
+}
+func (b *MemoryBroker) Close() {
+	b.once.Do(func() {
+		close(b.done)
+	})
+}
+func (b *MemoryBroker) Health() error {
+	select {
+	case <-b.done:
+		return errors.New("broker已关闭")
+	default:
+	}
+	return nil
+}
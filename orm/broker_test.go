@@ -0,0 +1,100 @@
+package orm
+
+import (
+	"testing"
+	"time"
+)
+
+// 收集回调收到的消息
+func brokerRecv(t *testing.T, ch chan string, want ...string) {
+	for _, body := range want {
+		select {
+		case got := <-ch:
+			if got != body {
+				t.Errorf("recv %q, want %q", got, body)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("recv timeout, want %q", body)
+		}
+	}
+	select {
+	case got := <-ch:
+		t.Errorf("unexpected %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBrokerPublish(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	ch1 := make(chan string, 10)
+	ch2 := make(chan string, 10)
+	b.Subscribe(func(body string) { ch1 <- body })
+	b.Subscribe(func(body string) { ch2 <- body })
+
+	// 全部订阅按顺序收到
+	for _, body := range []string{"a", "b", "c"} {
+		if err := b.Publish(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	brokerRecv(t, ch1, "a", "b", "c")
+	brokerRecv(t, ch2, "a", "b", "c")
+}
+
+func TestMemoryBrokerNode(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	all := make(chan string, 10)
+	n1 := make(chan string, 10)
+	n2 := make(chan string, 10)
+	b.Subscribe(func(body string) { all <- body })
+	b.SubscribeNode("n1", func(body string) { n1 <- body })
+	b.SubscribeNode("n2", func(body string) { n2 <- body })
+
+	tests := []struct {
+		node string
+		body string
+	}{
+		{"n1", "to n1"},
+		{"n2", "to n2"},
+		{"n3", "to n3"}, // 没有订阅的节点丢弃
+		{"n1", "to n1 again"},
+	}
+	for _, tt := range tests {
+		if err := b.PublishNode(tt.node, tt.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	brokerRecv(t, n1, "to n1", "to n1 again")
+	brokerRecv(t, n2, "to n2")
+	// 节点消息不发送给全部订阅
+	brokerRecv(t, all)
+
+	// 重新订阅时替换本节点的回调
+	n1New := make(chan string, 10)
+	b.SubscribeNode("n1", func(body string) { n1New <- body })
+	b.PublishNode("n1", "new")
+	brokerRecv(t, n1New, "new")
+	brokerRecv(t, n1)
+}
+
+func TestMemoryBrokerClose(t *testing.T) {
+	b := NewMemoryBroker()
+	if err := b.Health(); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	b.Close()
+	if err := b.Health(); err == nil {
+		t.Error("Health after Close = nil")
+	}
+	if err := b.Publish("x"); err == nil {
+		t.Error("Publish after Close = nil")
+	}
+	if err := b.PublishNode("n1", "x"); err == nil {
+		t.Error("PublishNode after Close = nil")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/go-ini/ini"
 	"github.com/sethvargo/go-envconfig"
+	"os"
 	"reflect"
 	"strconv"
 	"time"
@@ -12,16 +13,37 @@ import (
 
 var Config config
 
+// mqtt tcp 监听, 端口为 0 时不启动
+type MqttConf struct {
+	Port    int64  `env:"MQTT_PORT"`     // tcp 端口
+	TlsPort int64  `env:"MQTT_TLS_PORT"` // tls 端口
+	TlsCert string `env:"MQTT_TLS_CERT"` // tls 证书文件
+	TlsKey  string `env:"MQTT_TLS_KEY"`  // tls 私钥文件
+}
+
 type config struct {
-	Name  string `env:"HOST_NAME" default:"gmqtt"`
-	Port  int64  `env:"HOST_PORT" default:"8000"`
-	Debug bool   `env:"HOST_DEBUG" default:"true"`
-	Auth  string `env:"HOST_AUTH"`
+	Name      string `env:"HOST_NAME" default:"gmqtt"`
+	Port      int64  `env:"HOST_PORT" default:"8000"`
+	Debug     bool   `env:"HOST_DEBUG" default:"true"`
+	Auth      string `env:"HOST_AUTH"`
+	Broker    string `env:"HOST_BROKER" default:"rabbitmq"` // 消息中间件 rabbitmq redis memory
+	Admin     string `env:"HOST_ADMIN_TOKEN"`               // 管理接口密钥, 为空时关闭管理接口
+	Node      string `env:"HOST_NODE"`                      // 节点名称, 集群内唯一, 默认 主机名:端口
+	Duplicate string `env:"HOST_DUPLICATE_POLICY"`          // clientId 重复时 reject takeover allow
+	AuthFrame bool   `env:"HOST_AUTH_FRAME"`                // 握手时没有帐号信息时, 使用第一条 connect 消息验证
+	NoQuery   bool   `env:"HOST_AUTH_FORBID_QUERY"`         // 禁止在 url 参数中传递帐号密码
 
 	MySQL    MySqlConf
 	Redis    RedisConf
 	RabbitMQ RabbitMQConf
 	WJT      WJTConf
+	Qos      QosConf
+	Session  SessionConf
+	Mqtt     MqttConf
+	Presence PresenceConf
+	Webhook  WebhookConf
+	Acl      AclConf
+	Password PasswordConf
 }
 
 func (c *config) ReadEnv() error {
@@ -33,6 +55,22 @@ func (c *config) ReadEnv() error {
 	}
 
 	c.Redis.IdleTimeout = c.Redis.IdleTimeout * time.Second
+	if c.Broker == "" {
+		c.Broker = BrokerRabbitMQ
+	}
+	if c.Duplicate == "" {
+		c.Duplicate = DuplicateReject
+	}
+	if c.Password.Hash == "" {
+		c.Password.Hash = PasswordBcrypt
+	}
+	if c.Acl.Default == "" {
+		c.Acl.Default = AclAllow
+	}
+	if c.Node == "" {
+		hostname, _ := os.Hostname()
+		c.Node = hostname + ":" + strconv.Itoa(int(c.Port))
+	}
 
 	return nil
 }
@@ -50,6 +88,13 @@ func (c *config) ReadFileEnv() error {
 	c.setValueForMap(&c.Redis, EnvMap)
 	c.setValueForMap(&c.RabbitMQ, EnvMap)
 	c.setValueForMap(&c.WJT, EnvMap)
+	c.setValueForMap(&c.Qos, EnvMap)
+	c.setValueForMap(&c.Session, EnvMap)
+	c.setValueForMap(&c.Mqtt, EnvMap)
+	c.setValueForMap(&c.Presence, EnvMap)
+	c.setValueForMap(&c.Webhook, EnvMap)
+	c.setValueForMap(&c.Acl, EnvMap)
+	c.setValueForMap(&c.Password, EnvMap)
 	return nil
 }
 
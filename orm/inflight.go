@@ -0,0 +1,252 @@
+package orm
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+
+	qos 1 至少送达一次
+		sending		已发送等待客户端 ack 的消息, 数量不超过 QOS_WINDOW
+		waiting		窗口已满时等待发送的消息, 数量不超过 QOS_QUEUE
+	超过 QOS_TIMEOUT 未确认的消息重发, 最多重发 QOS_RETRY 次
+	客户端离线时不重发, 重连后重发全部未确认消息, 离线超过 QOS_EXPIRE 的消息丢弃
+	持久会话离线时未确认及等待的消息保存到离线队列, 随会话保留 SESSION_EXPIRE
+
+*/
+
+const (
+	qosWindow  = 32   // 默认窗口
+	qosQueue   = 1000 // 默认等待队列
+	qosTimeout = 20   // 默认重发时间 秒
+	qosRetry   = 5    // 默认重发次数
+	qosExpire  = 300  // 默认离线保留时间 秒
+)
+
+var InflightMap Inflight
+
+type QosConf struct {
+	Window  int64 `env:"QOS_WINDOW"`  // 每个客户端未确认消息数量
+	Queue   int64 `env:"QOS_QUEUE"`   // 窗口满后等待发送的消息数量
+	Timeout int64 `env:"QOS_TIMEOUT"` // 未确认重发时间 秒
+	Retry   int64 `env:"QOS_RETRY"`   // 最大重发次数
+	Expire  int64 `env:"QOS_EXPIRE"`  // 客户端离线后未确认消息保留时间 秒
+}
+
+type InflightMessage struct {
+	Message  OnelineMessage
+	Retry    int64     // 已重发次数
+	AddTime  time.Time // 加入时间
+	SendTime time.Time // 最近发送时间
+}
+
+type inflightWindow struct {
+	sending []*InflightMessage
+	waiting []*InflightMessage
+}
+
+type Inflight struct {
+	mutex   sync.Mutex
+	conf    QosConf
+	clients map[string]*inflightWindow // map[clientId]
+}
+
+func (f *Inflight) Init(conf QosConf) {
+	if conf.Window <= 0 {
+		conf.Window = qosWindow
+	}
+	if conf.Queue <= 0 {
+		conf.Queue = qosQueue
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = qosTimeout
+	}
+	if conf.Retry <= 0 {
+		conf.Retry = qosRetry
+	}
+	if conf.Expire <= 0 {
+		conf.Expire = qosExpire
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.conf = conf
+	if f.clients == nil {
+		f.clients = make(map[string]*inflightWindow)
+	}
+}
+
+// 加入窗口, 返回 true 需要立即发送, false 进入等待队列
+func (f *Inflight) Add(clientId string, msg OnelineMessage) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.clients == nil {
+		return false, errors.New("qos未初始化")
+	}
+	window, ok := f.clients[clientId]
+	if !ok {
+		window = &inflightWindow{}
+		f.clients[clientId] = window
+	}
+
+	now := time.Now()
+	item := &InflightMessage{
+		Message:  msg,
+		AddTime:  now,
+		SendTime: now,
+	}
+	if int64(len(window.sending)) < f.conf.Window {
+		window.sending = append(window.sending, item)
+		return true, nil
+	}
+	if int64(len(window.waiting)) >= f.conf.Queue {
+		return false, errors.New("qos等待队列已满#" + clientId)
+	}
+	window.waiting = append(window.waiting, item)
+	return false, nil
+}
+
+// 客户端确认消息, 返回窗口空出后需要发送的消息
+func (f *Inflight) Ack(clientId, id string) []OnelineMessage {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	window, ok := f.clients[clientId]
+	if !ok {
+		return nil
+	}
+	for i, item := range window.sending {
+		if item.Message.Id == id {
+			window.sending = append(window.sending[:i], window.sending[i+1:]...)
+			break
+		}
+	}
+	return f.fill(window)
+}
+
+// 超时需要重发的消息, online 判断客户端是否在线
+func (f *Inflight) Timeout(online func(clientId string) bool) map[string][]OnelineMessage {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	timeout := time.Duration(f.conf.Timeout) * time.Second
+	expire := time.Duration(f.conf.Expire) * time.Second
+
+	msgMap := make(map[string][]OnelineMessage)
+	for clientId, window := range f.clients {
+		if !online(clientId) {
+			window.sending = f.expire(window.sending, now.Add(-expire))
+			window.waiting = f.expire(window.waiting, now.Add(-expire))
+			if len(window.sending) <= 0 && len(window.waiting) <= 0 {
+				delete(f.clients, clientId)
+			}
+			continue
+		}
+
+		sending := window.sending[:0]
+		for _, item := range window.sending {
+			if now.Sub(item.SendTime) < timeout {
+				sending = append(sending, item)
+				continue
+			}
+			if item.Retry >= f.conf.Retry {
+				continue
+			}
+			item.Retry++
+			item.SendTime = now
+			item.Message.Dup = true
+			sending = append(sending, item)
+			msgMap[clientId] = append(msgMap[clientId], item.Message)
+		}
+		window.sending = sending
+		msgMap[clientId] = append(msgMap[clientId], f.fill(window)...)
+	}
+	return msgMap
+}
+
+// 客户端重连, 返回全部已发送未确认的消息
+func (f *Inflight) Resend(clientId string) []OnelineMessage {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	window, ok := f.clients[clientId]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	msgArr := make([]OnelineMessage, 0, len(window.sending))
+	for _, item := range window.sending {
+		item.SendTime = now
+		item.Message.Dup = true
+		msgArr = append(msgArr, item.Message)
+	}
+	return append(msgArr, f.fill(window)...)
+}
+
+// 取出客户端的全部消息并清理, 已发送未确认的消息标记为重发
+func (f *Inflight) Take(clientId string) []OnelineMessage {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	window, ok := f.clients[clientId]
+	if !ok {
+		return nil
+	}
+	delete(f.clients, clientId)
+	msgArr := make([]OnelineMessage, 0, len(window.sending)+len(window.waiting))
+	for _, item := range window.sending {
+		item.Message.Dup = true
+		msgArr = append(msgArr, item.Message)
+	}
+	for _, item := range window.waiting {
+		msgArr = append(msgArr, item.Message)
+	}
+	return msgArr
+}
+
+// 清理客户端的全部消息
+func (f *Inflight) Remove(clientId string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.clients, clientId)
+}
+
+// 客户端未确认及等待发送的消息数量
+func (f *Inflight) Len(clientId string) (int, int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	window, ok := f.clients[clientId]
+	if !ok {
+		return 0, 0
+	}
+	return len(window.sending), len(window.waiting)
+}
+
+// 窗口有空位时, 从等待队列补充
+func (f *Inflight) fill(window *inflightWindow) []OnelineMessage {
+	var msgArr []OnelineMessage
+	now := time.Now()
+	for int64(len(window.sending)) < f.conf.Window && len(window.waiting) > 0 {
+		item := window.waiting[0]
+		window.waiting = window.waiting[1:]
+		item.SendTime = now
+		window.sending = append(window.sending, item)
+		msgArr = append(msgArr, item.Message)
+	}
+	return msgArr
+}
+
+func (f *Inflight) expire(items []*InflightMessage, deadline time.Time) []*InflightMessage {
+	result := items[:0]
+	for _, item := range items {
+		if item.AddTime.After(deadline) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,196 @@
+package orm
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newInflight(window, queue int64) *Inflight {
+	f := &Inflight{}
+	f.Init(QosConf{Window: window, Queue: queue, Timeout: 10, Retry: 2, Expire: 60})
+	return f
+}
+
+func inflightMessage(i int) OnelineMessage {
+	return OnelineMessage{Action: "publish", Id: strconv.Itoa(i), Topic: "a", Qos: 1}
+}
+
+func inflightIds(msgArr []OnelineMessage) []string {
+	idArr := []string{}
+	for _, msg := range msgArr {
+		idArr = append(idArr, msg.Id)
+	}
+	return idArr
+}
+
+// 修改消息时间, 模拟时间经过
+func inflightShift(f *Inflight, clientId string, d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	window := f.clients[clientId]
+	for _, items := range [][]*InflightMessage{window.sending, window.waiting} {
+		for _, item := range items {
+			item.AddTime = item.AddTime.Add(-d)
+			item.SendTime = item.SendTime.Add(-d)
+		}
+	}
+}
+
+func TestInflightWindow(t *testing.T) {
+	var uninit Inflight
+	if _, err := uninit.Add("c", inflightMessage(0)); err == nil {
+		t.Error("Add before Init = nil")
+	}
+
+	f := newInflight(2, 2)
+	// 窗口满后进入等待队列, 等待队列满后拒绝
+	for i, want := range []bool{true, true, false, false} {
+		send, err := f.Add("c", inflightMessage(i))
+		if err != nil || send != want {
+			t.Errorf("Add %d = %v, %v, want %v", i, send, err, want)
+		}
+	}
+	if _, err := f.Add("c", inflightMessage(4)); err == nil {
+		t.Error("Add to full queue = nil")
+	}
+	if sending, waiting := f.Len("c"); sending != 2 || waiting != 2 {
+		t.Errorf("Len = %d, %d", sending, waiting)
+	}
+	// 其他客户端的窗口独立
+	if send, err := f.Add("other", inflightMessage(0)); !send || err != nil {
+		t.Errorf("Add other = %v, %v", send, err)
+	}
+
+	// 确认后从等待队列按顺序补充
+	tests := []struct {
+		ack  string
+		want []string
+	}{
+		{"9", []string{}},
+		{"1", []string{"2"}},
+		{"1", []string{}},
+		{"0", []string{"3"}},
+		{"2", []string{}},
+		{"3", []string{}},
+	}
+	for _, tt := range tests {
+		if got := inflightIds(f.Ack("c", tt.ack)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Ack %s = %v, want %v", tt.ack, got, tt.want)
+		}
+	}
+	if sending, waiting := f.Len("c"); sending != 0 || waiting != 0 {
+		t.Errorf("Len after ack = %d, %d", sending, waiting)
+	}
+	if got := f.Ack("none", "0"); got != nil {
+		t.Errorf("Ack unknown client = %v", got)
+	}
+}
+
+func TestInflightTimeout(t *testing.T) {
+	f := newInflight(1, 10)
+	f.Add("c", inflightMessage(0))
+	f.Add("c", inflightMessage(1))
+	online := func(clientId string) bool { return true }
+
+	// 未超时不重发
+	if got := f.Timeout(online); len(got["c"]) != 0 {
+		t.Errorf("Timeout before deadline = %v", got)
+	}
+
+	// 超时重发并标记 DUP
+	for retry := 1; retry <= 2; retry++ {
+		inflightShift(f, "c", 11*time.Second)
+		got := f.Timeout(online)["c"]
+		if len(got) != 1 || got[0].Id != "0" || !got[0].Dup {
+			t.Fatalf("retry %d = %+v", retry, got)
+		}
+	}
+
+	// 超过重发次数后丢弃, 等待的消息补充发送, 补充的消息不是重发
+	inflightShift(f, "c", 11*time.Second)
+	got := f.Timeout(online)["c"]
+	if len(got) != 1 || got[0].Id != "1" || got[0].Dup {
+		t.Errorf("after max retry = %+v", got)
+	}
+	if sending, waiting := f.Len("c"); sending != 1 || waiting != 0 {
+		t.Errorf("Len = %d, %d", sending, waiting)
+	}
+}
+
+func TestInflightResend(t *testing.T) {
+	f := newInflight(1, 10)
+	if got := f.Resend("c"); got != nil {
+		t.Errorf("Resend unknown client = %v", got)
+	}
+	f.Add("c", inflightMessage(0))
+	f.Add("c", inflightMessage(1))
+
+	// 重连后重发未确认的消息, 窗口已满等待的不发送
+	got := f.Resend("c")
+	if len(got) != 1 || got[0].Id != "0" || !got[0].Dup {
+		t.Errorf("Resend = %+v", got)
+	}
+	got = f.Ack("c", "0")
+	if len(got) != 1 || got[0].Id != "1" || got[0].Dup {
+		t.Errorf("Ack after resend = %+v", got)
+	}
+}
+
+func TestInflightOffline(t *testing.T) {
+	f := newInflight(1, 10)
+	f.Add("c", inflightMessage(0))
+	f.Add("c", inflightMessage(1))
+	offline := func(clientId string) bool { return false }
+
+	// 离线时不重发, 未过期的消息保留
+	inflightShift(f, "c", 30*time.Second)
+	if got := f.Timeout(offline); len(got["c"]) != 0 {
+		t.Errorf("Timeout offline = %v", got)
+	}
+	if sending, waiting := f.Len("c"); sending != 1 || waiting != 1 {
+		t.Errorf("Len offline = %d, %d", sending, waiting)
+	}
+
+	// 离线超过 QOS_EXPIRE 后丢弃并清理客户端
+	inflightShift(f, "c", 31*time.Second)
+	f.Timeout(offline)
+	f.mutex.Lock()
+	_, ok := f.clients["c"]
+	f.mutex.Unlock()
+	if ok {
+		t.Error("expired client not removed")
+	}
+}
+
+func TestInflightDisconnect(t *testing.T) {
+	f := newInflight(1, 10)
+	f.Add("c", inflightMessage(0))
+	f.Add("c", inflightMessage(1))
+
+	// 持久会话取出全部消息, 已发送的标记重发
+	got := f.Take("c")
+	if ids := inflightIds(got); !reflect.DeepEqual(ids, []string{"0", "1"}) {
+		t.Fatalf("Take = %v", ids)
+	}
+	if !got[0].Dup || got[1].Dup {
+		t.Errorf("Take dup = %v, %v", got[0].Dup, got[1].Dup)
+	}
+	if sending, waiting := f.Len("c"); sending != 0 || waiting != 0 {
+		t.Errorf("Len after Take = %d, %d", sending, waiting)
+	}
+	if got := f.Take("c"); got != nil {
+		t.Errorf("Take again = %v", got)
+	}
+
+	// 非持久会话直接清理
+	f.Add("c", inflightMessage(2))
+	f.Remove("c")
+	if sending, waiting := f.Len("c"); sending != 0 || waiting != 0 {
+		t.Errorf("Len after Remove = %d, %d", sending, waiting)
+	}
+	if got := f.Resend("c"); got != nil {
+		t.Errorf("Resend after Remove = %v", got)
+	}
+}
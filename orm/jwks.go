@@ -0,0 +1,350 @@
+package orm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+	wjt 非对称签名, 支持 RS256 ES256 EdDSA 等
+		WJT_PRIVATE_KEY	签名私钥 pem 文件, 签发时 header 的 kid 为 WJT_KEY_ID, 默认为文件名
+		WJT_PUBLIC_KEYS	验证公钥 pem 文件, 多个用逗号分隔, kid 为文件名(不含扩展名), 轮换时新旧公钥同时配置
+		WJT_JWKS_URL	身份服务的 jwks 地址, 按 WJT_JWKS_CACHE 秒缓存, 遇到未知 kid 时重新获取
+	验证时按 token header 的 kid 查找公钥, 没有 kid 时使用唯一可用的公钥
+
+*/
+
+const (
+	jwksTimeout  = 5 * time.Second  // 获取 jwks 超时
+	jwksInterval = 10 * time.Second // 重新获取的最小间隔
+)
+
+var SigningMethodEdDSA = &signingMethodEd25519{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+// jwt-go 没有 EdDSA, 使用 ed25519 实现
+type signingMethodEd25519 struct{}
+
+func (m *signingMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+// 读取 pem 私钥, 支持 pkcs8 pkcs1 ec
+func LoadPrivateKey(file string) (crypto.Signer, error) {
+	block, err := readPem(file)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("私钥格式错误#" + file)
+}
+
+// 读取 pem 公钥, 支持 pkix pkcs1 及证书
+func LoadPublicKey(file string) (crypto.PublicKey, error) {
+	block, err := readPem(file)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func readPem(file string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("pem格式错误#" + file)
+	}
+	return block, nil
+}
+
+// 文件名作为 kid
+func keyIdFromFile(file string) string {
+	name := filepath.Base(file)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// 公钥是否可用于签名算法
+func keyMatchMethod(key crypto.PublicKey, method jwt.SigningMethod) bool {
+	switch m := method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodECDSA:
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		return ok && publicKey.Curve.Params().BitSize == m.CurveBits
+	case *signingMethodEd25519:
+		_, ok := key.(ed25519.PublicKey)
+		return ok
+	}
+	return false
+}
+
+// 按 kid 查找公钥, kid 为空时使用唯一可用的公钥
+func findKey(keys map[string]crypto.PublicKey, kid string, method jwt.SigningMethod) crypto.PublicKey {
+	if kid != "" {
+		if key, ok := keys[kid]; ok && keyMatchMethod(key, method) {
+			return key
+		}
+		return nil
+	}
+	var found crypto.PublicKey
+	for _, key := range keys {
+		if !keyMatchMethod(key, method) {
+			continue
+		}
+		if found != nil {
+			return nil
+		}
+		found = key
+	}
+	return found
+}
+
+// jwks 缓存
+type jwksCache struct {
+	url     string
+	ttl     time.Duration
+	client  *http.Client
+	mutex   sync.RWMutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time     // 最后获取时间
+	expire  time.Time     // 缓存过期时间
+	loading chan struct{} // 正在获取时不为 nil, 获取完成后关闭
+}
+
+func newJwksCache(url string, ttl time.Duration) *jwksCache {
+	return &jwksCache{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: jwksTimeout},
+	}
+}
+
+// 查找公钥, 缓存过期或 kid 未知时重新获取
+func (j *jwksCache) find(kid string, method jwt.SigningMethod) (crypto.PublicKey, error) {
+	j.mutex.RLock()
+	key := findKey(j.keys, kid, method)
+	expired := time.Now().After(j.expire)
+	j.mutex.RUnlock()
+	if key != nil && !expired {
+		return key, nil
+	}
+
+	if err := j.refresh(); err != nil {
+		log.Println("[jwks]", j.url, err.Error())
+	}
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+	if key := findKey(j.keys, kid, method); key != nil {
+		return key, nil
+	}
+	return nil, errors.New("token kid错误")
+}
+
+// 重新获取, 获取失败时继续使用旧的公钥, 间隔小于 jwksInterval 时不获取
+// 请求在锁外进行, 同时到达的调用等待正在进行的获取完成, 不重复请求
+func (j *jwksCache) refresh() error {
+	j.mutex.Lock()
+	if loading := j.loading; loading != nil {
+		j.mutex.Unlock()
+		<-loading
+		return nil
+	}
+	now := time.Now()
+	if now.Sub(j.fetched) < jwksInterval {
+		j.mutex.Unlock()
+		return nil
+	}
+	j.fetched = now
+	loading := make(chan struct{})
+	j.loading = loading
+	j.mutex.Unlock()
+
+	keys, err := j.fetch()
+
+	j.mutex.Lock()
+	if err == nil {
+		j.keys = keys
+		j.expire = now.Add(j.ttl)
+	}
+	j.loading = nil
+	j.mutex.Unlock()
+	close(loading)
+	return err
+}
+
+func (j *jwksCache) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks状态码错误#%d", resp.StatusCode)
+	}
+
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for i, item := range document.Keys {
+		if item.Use != "" && item.Use != "sig" {
+			continue
+		}
+		key, err := item.publicKey()
+		if err != nil {
+			log.Println("[jwks]", j.url, item.Kid, err.Error())
+			continue
+		}
+		kid := item.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("#%d", i)
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("不支持的曲线#" + k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("公钥不在曲线上")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.New("不支持的曲线#" + k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("ed25519公钥长度错误")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("不支持的kty#" + k.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -1,14 +1,34 @@
 package orm
 
 import (
+	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
+/*
+
+	mysql 帐号验证
+		MYSQL_AUTH_TABLE MYSQL_AUTH_FIELD_* 等表名字段名只能是字母数字下划线, 可带库名 db.table, 查询时加反引号
+		MYSQL_AUTH_WHERE	额外条件, 如 status=1, 不能包含 ; -- /* #
+		MYSQL_AUTH_HASH		密码字段为 md5 sha1 sha256 sha512 加盐摘要时设置, 为空时按前缀识别, 见 password.go
+		MYSQL_ROLE_TABLE	角色表, 按 MYSQL_ROLE_FIELD_USER 关联帐号表的 MYSQL_AUTH_FIELD_ID
+		MYSQL_AUTH_CACHE	帐号及主题权限缓存时间(秒), 修改密码或权限后最多延迟该时间生效
+
+*/
+
+const mysqlCacheClean = time.Minute // 缓存清理间隔
+
 var MySql MySqlConn
 
+var mysqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*)?$`)
+
 type MySqlConf struct {
 	Host              string `env:"MYSQL_HOST"`
 	Port              int64  `env:"MYSQL_PORT"`
@@ -20,17 +40,45 @@ type MySqlConf struct {
 	AuthTable         string `env:"MYSQL_AUTH_TABLE"`          // 验证表
 	AuthFieldUsername string `env:"MYSQL_AUTH_FIELD_USERNAME"` // 验证字段username
 	AuthFieldPassword string `env:"MYSQL_AUTH_FIELD_PASSWORD"` // 验证字段password
+	AuthFieldRole     string `env:"MYSQL_AUTH_FIELD_ROLE"`     // 角色字段, 逗号分隔, 为空时无角色
+	AuthFieldId       string `env:"MYSQL_AUTH_FIELD_ID"`       // 用户id字段, 设置了角色表时默认 id
+	AuthFieldSalt     string `env:"MYSQL_AUTH_FIELD_SALT"`     // 盐字段, MYSQL_AUTH_HASH 使用
+	AuthHash          string `env:"MYSQL_AUTH_HASH"`           // 密码摘要算法 md5 sha1 sha256 sha512
+	AuthSaltFirst     bool   `env:"MYSQL_AUTH_SALT_FIRST"`     // 摘要为 盐+密码, 默认 密码+盐
+	AuthWhere         string `env:"MYSQL_AUTH_WHERE"`          // 额外条件
+	AuthCache         int64  `env:"MYSQL_AUTH_CACHE"`          // 缓存时间(秒), 0 不缓存
+	RoleTable         string `env:"MYSQL_ROLE_TABLE"`          // 角色表, 为空时不使用
+	RoleFieldUser     string `env:"MYSQL_ROLE_FIELD_USER"`     // 角色表关联用户id的字段, 默认 user_id
+	RoleFieldRole     string `env:"MYSQL_ROLE_FIELD_ROLE"`     // 角色表的角色字段, 默认 role
+	AclTable          string `env:"MYSQL_ACL_TABLE"`           // 主题权限表, 为空时无规则
+}
+
+// 帐号表中的记录
+type MySqlUser struct {
+	Id       string   `gorm:"column:id"`
+	Password string   `gorm:"column:password"`
+	Salt     string   `gorm:"column:salt"`
+	Role     string   `gorm:"column:role"`
+	Roles    []string `gorm:"-"` // 角色字段及角色表的角色
 }
 
 type MySqlConn struct {
 	Conf MySqlConf
 	Conn *gorm.DB
+
+	userSql  string // 按帐号查询
+	roleSql  string // 按用户id查询角色表
+	aclTable string
+	cache    *mysqlCache
 }
 
 func (obj *MySqlConn) Connect(conf MySqlConf) error {
 	log.Println("connect mysql")
 
 	obj.Conf = conf
+	if err := obj.prepare(); err != nil {
+		return err
+	}
 	connArgs := fmt.Sprintf("%s:%s@(%s:%v)/%s?charset=utf8&parseTime=True&loc=Local&timeout=100ms",
 		obj.Conf.User, obj.Conf.Password, obj.Conf.Host, obj.Conf.Port, obj.Conf.Database)
 
@@ -59,17 +107,248 @@ func (obj *MySqlConn) Close() {
 		obj.Conn.Close()
 	}
 }
-func (obj *MySqlConn) Check(username, password string) (bool, error) {
-	db := obj.Conn.Table(obj.Conf.AuthTable).Select("count(1) as num")
-	db = db.Where(obj.Conf.AuthFieldUsername+"=?", username)
-	db = db.Where(obj.Conf.AuthFieldPassword+"=?", password)
 
-	var num int = 0
-	if err := db.Count(&num).Error; err != nil {
+// 检查表名字段名, 生成查询语句
+func (obj *MySqlConn) prepare() error {
+	conf := &obj.Conf
+	if conf.RoleTable != "" {
+		if conf.AuthFieldId == "" {
+			conf.AuthFieldId = "id"
+		}
+		if conf.RoleFieldUser == "" {
+			conf.RoleFieldUser = "user_id"
+		}
+		if conf.RoleFieldRole == "" {
+			conf.RoleFieldRole = "role"
+		}
+	}
+	if conf.AuthHash != "" && !digestSupported(conf.AuthHash) {
+		return errors.New("MYSQL_AUTH_HASH不支持#" + conf.AuthHash)
+	}
+
+	table, err := quoteIdentifier(conf.AuthTable)
+	if err != nil {
+		return err
+	}
+	username, err := quoteIdentifier(conf.AuthFieldUsername)
+	if err != nil {
+		return err
+	}
+	password, err := quoteIdentifier(conf.AuthFieldPassword)
+	if err != nil {
+		return err
+	}
+	columns := []string{password + " as password"}
+	for _, item := range []struct{ field, alias string }{
+		{conf.AuthFieldId, "id"},
+		{conf.AuthFieldSalt, "salt"},
+		{conf.AuthFieldRole, "role"},
+	} {
+		if item.field == "" {
+			continue
+		}
+		field, err := quoteIdentifier(item.field)
+		if err != nil {
+			return err
+		}
+		columns = append(columns, field+" as "+item.alias)
+	}
+	where := username + "=?"
+	if condition := strings.TrimSpace(conf.AuthWhere); condition != "" {
+		if strings.ContainsAny(condition, ";#") || strings.Contains(condition, "--") || strings.Contains(condition, "/*") {
+			return errors.New("MYSQL_AUTH_WHERE不能包含 ; -- /* #")
+		}
+		where += " and (" + condition + ")"
+	}
+	obj.userSql = "select " + strings.Join(columns, ", ") + " from " + table + " where " + where + " limit 1"
+
+	obj.roleSql = ""
+	if conf.RoleTable != "" {
+		roleTable, err := quoteIdentifier(conf.RoleTable)
+		if err != nil {
+			return err
+		}
+		roleUser, err := quoteIdentifier(conf.RoleFieldUser)
+		if err != nil {
+			return err
+		}
+		roleRole, err := quoteIdentifier(conf.RoleFieldRole)
+		if err != nil {
+			return err
+		}
+		obj.roleSql = "select " + roleRole + " as role from " + roleTable + " where " + roleUser + "=?"
+	}
+
+	// gorm 的 Table 会加反引号, 只检查
+	obj.aclTable = ""
+	if conf.AclTable != "" {
+		if _, err := quoteIdentifier(conf.AclTable); err != nil {
+			return err
+		}
+		obj.aclTable = conf.AclTable
+	}
+
+	obj.cache = nil
+	if conf.AuthCache > 0 {
+		obj.cache = newMysqlCache(time.Duration(conf.AuthCache) * time.Second)
+	}
+	return nil
+}
+
+// 表名字段名加反引号, db.table 分别处理
+func quoteIdentifier(name string) (string, error) {
+	if !mysqlIdentifier.MatchString(name) {
+		return "", errors.New("mysql表名或字段名错误#" + name)
+	}
+	return "`" + strings.Replace(name, ".", "`.`", 1) + "`", nil
+}
+
+func digestSupported(algorithm string) bool {
+	switch algorithm {
+	case "md5", "sha1", "sha256", "sha512":
+		return true
+	}
+	return false
+}
+
+// 按帐号读取记录及角色, 帐号不存在或不满足 MYSQL_AUTH_WHERE 时返回 nil
+func (obj *MySqlConn) User(username string) (*MySqlUser, error) {
+	key := "user:" + username
+	if value, ok := obj.cache.get(key); ok {
+		return value.(*MySqlUser), nil
+	}
+
+	var rows []MySqlUser
+	if err := obj.Conn.Raw(obj.userSql, username).Scan(&rows).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	var user *MySqlUser
+	if len(rows) > 0 {
+		user = &rows[0]
+		user.Roles = splitList(user.Role)
+		if obj.roleSql != "" && user.Id != "" {
+			var roleRows []struct {
+				Role string `gorm:"column:role"`
+			}
+			if err := obj.Conn.Raw(obj.roleSql, user.Id).Scan(&roleRows).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+				return nil, err
+			}
+			for _, row := range roleRows {
+				if row.Role != "" {
+					user.Roles = append(user.Roles, row.Role)
+				}
+			}
+		}
+	}
+	obj.cache.set(key, user)
+	return user, nil
+}
+
+// 验证密码, 设置了 MYSQL_AUTH_HASH 时按加盐摘要验证
+func (obj *MySqlConn) CheckUser(user *MySqlUser, password string) bool {
+	if user == nil {
+		return false
+	}
+	if obj.Conf.AuthHash != "" {
+		return CheckDigest(obj.Conf.AuthHash, password, user.Salt, user.Password, obj.Conf.AuthSaltFirst)
+	}
+	return CheckPassword(password, user.Password)
+}
+
+// 按帐号读取密码字段验证, 密码字段可以是哈希
+func (obj *MySqlConn) Check(username, password string) (bool, error) {
+	user, err := obj.User(username)
+	if err != nil {
 		return false, err
 	}
-	if num <= 0 {
-		return false, nil
+	return obj.CheckUser(user, password), nil
+}
+
+// 帐号的角色
+func (obj *MySqlConn) Roles(username string) ([]string, error) {
+	user, err := obj.User(username)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	return user.Roles, nil
+}
+
+// 帐号及 clientId 的主题权限规则
+func (obj *MySqlConn) AclRules(username, clientId string, roles []string) ([]AclRule, error) {
+	var rules []AclRule
+	if obj.aclTable == "" {
+		return rules, nil
+	}
+	key := "acl:" + username + "\x00" + clientId + "\x00" + strings.Join(roles, ",")
+	if value, ok := obj.cache.get(key); ok {
+		return value.([]AclRule), nil
+	}
+
+	db := obj.Conn.Table(obj.aclTable)
+	if len(roles) > 0 {
+		db = db.Where("username=? or client_id=? or role in (?) or (username='' and client_id='' and role='')", username, clientId, roles)
+	} else {
+		db = db.Where("username=? or client_id=? or (username='' and client_id='' and role='')", username, clientId)
+	}
+	if err := db.Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	obj.cache.set(key, rules)
+	return rules, nil
+}
+
+// 查询结果缓存, 为 nil 时不缓存
+type mysqlCache struct {
+	ttl   time.Duration
+	mutex sync.Mutex
+	items map[string]mysqlCacheItem
+	clean time.Time // 最后清理时间
+}
+
+type mysqlCacheItem struct {
+	value  interface{}
+	expire time.Time
+}
+
+func newMysqlCache(ttl time.Duration) *mysqlCache {
+	return &mysqlCache{
+		ttl:   ttl,
+		items: make(map[string]mysqlCacheItem),
+		clean: time.Now(),
+	}
+}
+
+func (c *mysqlCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	item, ok := c.items[key]
+	if !ok || time.Now().After(item.expire) {
+		return nil, false
+	}
+	return item.value, true
+}
+
+// 写入时定期清理过期的记录
+func (c *mysqlCache) set(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(c.clean) > mysqlCacheClean {
+		for k, item := range c.items {
+			if now.After(item.expire) {
+				delete(c.items, k)
+			}
+		}
+		c.clean = now
+	}
+	c.items[key] = mysqlCacheItem{
+		value:  value,
+		expire: now.Add(c.ttl),
 	}
-	return true, nil
 }
@@ -0,0 +1,190 @@
+package orm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := []struct {
+		name  string
+		want  string
+		valid bool
+	}{
+		{"user", "`user`", true},
+		{"user_user", "`user_user`", true},
+		{"_tmp1", "`_tmp1`", true},
+		{"db.user", "`db`.`user`", true},
+		{"a$b", "`a$b`", true},
+		{"", "", false},
+		{"1user", "", false},
+		{"user name", "", false},
+		{"user`", "", false},
+		{"`user`", "", false},
+		{"user;drop", "", false},
+		{"user--", "", false},
+		{"db.user.id", "", false},
+		{"db.", "", false},
+		{".user", "", false},
+		{"user-name", "", false},
+		{"用户", "", false},
+		{"user\n", "", false},
+	}
+	for _, tt := range tests {
+		got, err := quoteIdentifier(tt.name)
+		if (err == nil) != tt.valid {
+			t.Errorf("quoteIdentifier(%q) err = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("quoteIdentifier(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMysqlPrepare(t *testing.T) {
+	base := MySqlConf{AuthTable: "user", AuthFieldUsername: "mobile", AuthFieldPassword: "verify"}
+	tests := []struct {
+		name    string
+		conf    func(conf *MySqlConf)
+		userSql string
+		roleSql string
+		valid   bool
+	}{
+		{
+			"default",
+			func(conf *MySqlConf) {},
+			"select `verify` as password from `user` where `mobile`=? limit 1",
+			"",
+			true,
+		},
+		{
+			"salt role where",
+			func(conf *MySqlConf) {
+				conf.AuthTable = "app.user"
+				conf.AuthFieldSalt = "salt"
+				conf.AuthFieldRole = "roles"
+				conf.AuthHash = "md5"
+				conf.AuthWhere = " status=1 or deleted=0 "
+			},
+			"select `verify` as password, `salt` as salt, `roles` as role from `app`.`user` where `mobile`=? and (status=1 or deleted=0) limit 1",
+			"",
+			true,
+		},
+		{
+			"role table defaults",
+			func(conf *MySqlConf) { conf.RoleTable = "user_role" },
+			"select `verify` as password, `id` as id from `user` where `mobile`=? limit 1",
+			"select `role` as role from `user_role` where `user_id`=?",
+			true,
+		},
+		{
+			"role table fields",
+			func(conf *MySqlConf) {
+				conf.AuthFieldId = "uid"
+				conf.RoleTable = "acl.role"
+				conf.RoleFieldUser = "uid"
+				conf.RoleFieldRole = "name"
+			},
+			"select `verify` as password, `uid` as id from `user` where `mobile`=? limit 1",
+			"select `name` as role from `acl`.`role` where `uid`=?",
+			true,
+		},
+		{"no table", func(conf *MySqlConf) { conf.AuthTable = "" }, "", "", false},
+		{"bad table", func(conf *MySqlConf) { conf.AuthTable = "user where 1=1" }, "", "", false},
+		{"bad username", func(conf *MySqlConf) { conf.AuthFieldUsername = "mobile`" }, "", "", false},
+		{"bad password", func(conf *MySqlConf) { conf.AuthFieldPassword = "a,b" }, "", "", false},
+		{"bad salt", func(conf *MySqlConf) { conf.AuthFieldSalt = "salt()" }, "", "", false},
+		{"bad role field", func(conf *MySqlConf) { conf.AuthFieldRole = "1role" }, "", "", false},
+		{"bad role table", func(conf *MySqlConf) { conf.RoleTable = "role;" }, "", "", false},
+		{"bad role user", func(conf *MySqlConf) { conf.RoleTable = "role"; conf.RoleFieldUser = "a b" }, "", "", false},
+		{"bad acl table", func(conf *MySqlConf) { conf.AclTable = "acl`" }, "", "", false},
+		{"bad hash", func(conf *MySqlConf) { conf.AuthHash = "crc32" }, "", "", false},
+		{"where semicolon", func(conf *MySqlConf) { conf.AuthWhere = "1=1; drop table user" }, "", "", false},
+		{"where comment", func(conf *MySqlConf) { conf.AuthWhere = "1=1 -- x" }, "", "", false},
+		{"where block comment", func(conf *MySqlConf) { conf.AuthWhere = "1=1 /* x */" }, "", "", false},
+		{"where hash comment", func(conf *MySqlConf) { conf.AuthWhere = "1=1 # x" }, "", "", false},
+	}
+	for _, tt := range tests {
+		obj := MySqlConn{Conf: base}
+		tt.conf(&obj.Conf)
+		err := obj.prepare()
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: prepare err = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if obj.userSql != tt.userSql {
+			t.Errorf("%s: userSql = %q, want %q", tt.name, obj.userSql, tt.userSql)
+		}
+		if obj.roleSql != tt.roleSql {
+			t.Errorf("%s: roleSql = %q, want %q", tt.name, obj.roleSql, tt.roleSql)
+		}
+	}
+
+	// 主题权限表只检查, 缓存按配置创建
+	obj := MySqlConn{Conf: base}
+	obj.Conf.AclTable = "db.acl"
+	obj.Conf.AuthCache = 10
+	if err := obj.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if obj.aclTable != "db.acl" || obj.cache == nil || obj.cache.ttl != 10*time.Second {
+		t.Errorf("aclTable = %q, cache = %+v", obj.aclTable, obj.cache)
+	}
+	obj.Conf.AuthCache = 0
+	if err := obj.prepare(); err != nil || obj.cache != nil {
+		t.Errorf("AuthCache 0: err = %v, cache = %+v", err, obj.cache)
+	}
+}
+
+func TestMysqlCache(t *testing.T) {
+	// 未开启缓存
+	var disabled *mysqlCache
+	disabled.set("a", 1)
+	if _, ok := disabled.get("a"); ok {
+		t.Error("nil cache get ok")
+	}
+
+	cache := newMysqlCache(time.Minute)
+	if _, ok := cache.get("a"); ok {
+		t.Error("empty cache get ok")
+	}
+	cache.set("a", 1)
+	cache.set("none", (*MySqlUser)(nil))
+	if value, ok := cache.get("a"); !ok || value != 1 {
+		t.Errorf("get a = %v, %v", value, ok)
+	}
+	// 帐号不存在的结果也缓存
+	if value, ok := cache.get("none"); !ok || value.(*MySqlUser) != nil {
+		t.Errorf("get none = %v, %v", value, ok)
+	}
+
+	// 过期后不返回
+	cache.mutex.Lock()
+	item := cache.items["a"]
+	item.expire = time.Now().Add(-time.Second)
+	cache.items["a"] = item
+	cache.mutex.Unlock()
+	if _, ok := cache.get("a"); ok {
+		t.Error("expired item returned")
+	}
+
+	// 超过清理间隔后写入时删除过期的记录
+	cache.set("b", 2)
+	if _, ok := cache.items["a"]; !ok {
+		t.Error("expired item removed before clean interval")
+	}
+	cache.clean = time.Now().Add(-2 * mysqlCacheClean)
+	cache.set("c", 3)
+	if _, ok := cache.items["a"]; ok {
+		t.Error("expired item not removed")
+	}
+	for _, key := range []string{"b", "c", "none"} {
+		if _, ok := cache.get(key); !ok {
+			t.Errorf("item %s removed", key)
+		}
+	}
+}
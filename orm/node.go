@@ -0,0 +1,359 @@
+package orm
+
+import (
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+	集群在线状态
+		client:{clientId}	hash	node 所在节点, username 帐号, ip, connectTime 连接时间, 过期时间 PRESENCE_TTL 秒
+									node:{节点} 有连接的节点 => 过期时间, allow 时同一 clientId 可在多个节点在线
+		presence			zset	clientId => 过期时间, 查询集群在线列表
+	本节点每 PRESENCE_TTL/3 秒刷新在线客户端的过期时间, 节点异常退出后记录自动过期
+	redis 未连接时只查询本节点的在线客户端
+
+*/
+
+const (
+	presenceTtl     = 60   // 默认在线记录过期时间 秒
+	presenceListMax = 1000 // 在线列表一页最大数量
+)
+
+var NodeMap Node
+
+var (
+	ErrClientOffline = errors.New("客户端不在线")
+	ErrClientExist   = errors.New("clientId已在线")
+)
+
+type PresenceConf struct {
+	Ttl int64 `env:"PRESENCE_TTL"` // 在线记录过期时间 秒
+}
+
+// 客户端在线记录
+type Presence struct {
+	ClientId    string    `json:"clientId"`
+	Node        string    `json:"node"`
+	Username    string    `json:"username"`
+	Ip          string    `json:"ip"`
+	ConnectTime time.Time `json:"connectTime"`
+}
+
+type Node struct {
+	mutex sync.Mutex
+	name  string
+	conf  PresenceConf
+	done  chan bool
+}
+
+func (n *Node) Init(name string, conf PresenceConf) {
+	if conf.Ttl <= 0 {
+		conf.Ttl = presenceTtl
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.name = name
+	n.conf = conf
+}
+
+// 本节点名称
+func (n *Node) Name() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.name
+}
+
+func (n *Node) key(clientId string) string {
+	return "client:" + clientId
+}
+
+const (
+	presenceKey  = "presence"
+	presenceNode = "node:"
+)
+
+// 定时刷新本节点在线客户端的过期时间
+func (n *Node) Run() {
+	n.mutex.Lock()
+	if n.done != nil {
+		n.mutex.Unlock()
+		return
+	}
+	n.done = make(chan bool)
+	interval := time.Duration(n.conf.Ttl) * time.Second / 3
+	n.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n.heartbeat()
+			case <-n.done:
+				return
+			}
+		}
+	}()
+}
+
+func (n *Node) heartbeat() {
+	if !Redis.IsConnected() {
+		return
+	}
+	OnlineMap.Range(func(clientId string, conn *Connection) bool {
+		if err := n.save(conn.Info()); err != nil {
+			log.Println("[presence]", clientId, err.Error())
+		}
+		return true
+	})
+	// 清理过期的在线列表
+	Redis.ZRemRangeByScore(presenceKey, "-inf", strconv.FormatInt(time.Now().Unix(), 10))
+}
+
+// 写入在线记录并刷新过期时间
+func (n *Node) save(info ConnectionInfo) error {
+	key := n.key(info.ClientId)
+	expire := time.Now().Unix() + n.conf.Ttl
+	if _, err := Redis.HSetMap(key, map[string]string{
+		"node":                  n.Name(),
+		presenceNode + n.Name(): strconv.FormatInt(expire, 10),
+		"username":              info.Username,
+		"ip":                    info.Ip,
+		"connectTime":           strconv.FormatInt(info.ConnectTime.Unix(), 10),
+	}); err != nil {
+		return err
+	}
+	if err := Redis.Expire(key, n.conf.Ttl); err != nil {
+		return err
+	}
+	_, err := Redis.ZAdd(presenceKey, expire, info.ClientId)
+	return err
+}
+
+// 登记客户端在本节点在线, 需先加入 OnlineMap, 其他节点已在线时返回 ErrClientExist, force 时直接覆盖
+func (n *Node) Register(info ConnectionInfo, force bool) error {
+	if !Redis.IsConnected() {
+		return nil
+	}
+	key := n.key(info.ClientId)
+	if force {
+		return n.save(info)
+	}
+	if err := Redis.HSetNX(key, "node", n.Name()); err != nil {
+		node, err := Redis.HGet(key, "node")
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		// 本节点残留的记录可以覆盖
+		if err == nil && node != n.Name() {
+			return ErrClientExist
+		}
+	}
+	return n.save(info)
+}
+
+// 客户端在本节点离线, 其他节点还有连接时保留记录, 所在节点改为其他节点
+func (n *Node) Unregister(clientId string) error {
+	if !Redis.IsConnected() {
+		return nil
+	}
+	key := n.key(clientId)
+	if _, err := Redis.HDel(key, presenceNode+n.Name()); err != nil {
+		return err
+	}
+	dataMap, err := Redis.HGetAll(key)
+	if err != nil {
+		return err
+	}
+	if dataMap["node"] != "" && dataMap["node"] != n.Name() {
+		// 已被其他节点接管
+		return nil
+	}
+	now := time.Now().Unix()
+	for field, value := range dataMap {
+		if !strings.HasPrefix(field, presenceNode) {
+			continue
+		}
+		if expire, _ := strconv.ParseInt(value, 10, 64); expire > now {
+			_, err := Redis.HSet(key, "node", strings.TrimPrefix(field, presenceNode))
+			return err
+		}
+	}
+	Redis.ZRem(presenceKey, clientId)
+	return Redis.Del(key)
+}
+
+// 查询客户端所在节点
+func (n *Node) Lookup(clientId string) (string, error) {
+	if OnlineMap.Exist(clientId) == nil {
+		return n.Name(), nil
+	}
+	if !Redis.IsConnected() {
+		return "", ErrClientOffline
+	}
+	node, err := Redis.HGet(n.key(clientId), "node")
+	if err == redis.ErrNil {
+		return "", ErrClientOffline
+	}
+	if err != nil {
+		return "", err
+	}
+	return node, nil
+}
+
+// 查询客户端在线的全部节点, allow 时同一 clientId 可在多个节点在线, 本节点在前
+func (n *Node) Nodes(clientId string) ([]string, error) {
+	var nodeArr []string
+	if OnlineMap.Exist(clientId) == nil {
+		nodeArr = append(nodeArr, n.Name())
+	}
+	if !Redis.IsConnected() {
+		if len(nodeArr) <= 0 {
+			return nil, ErrClientOffline
+		}
+		return nodeArr, nil
+	}
+	dataMap, err := Redis.HGetAll(n.key(clientId))
+	if err != nil {
+		if len(nodeArr) > 0 {
+			return nodeArr, nil
+		}
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	var remoteArr []string
+	for field, value := range dataMap {
+		if !strings.HasPrefix(field, presenceNode) {
+			continue
+		}
+		node := strings.TrimPrefix(field, presenceNode)
+		if node == n.Name() {
+			continue
+		}
+		if expire, _ := strconv.ParseInt(value, 10, 64); expire > now {
+			remoteArr = append(remoteArr, node)
+		}
+	}
+	sort.Strings(remoteArr)
+	nodeArr = append(nodeArr, remoteArr...)
+	if len(nodeArr) <= 0 {
+		return nil, ErrClientOffline
+	}
+	return nodeArr, nil
+}
+
+// 客户端是否在集群中在线
+func (n *Node) Exist(clientId string) bool {
+	_, err := n.Lookup(clientId)
+	return err == nil
+}
+
+// 查询客户端在线记录
+func (n *Node) Get(clientId string) (*Presence, error) {
+	if conn, err := OnlineMap.Get(clientId); err == nil {
+		return n.local(clientId, conn), nil
+	}
+	if !Redis.IsConnected() {
+		return nil, ErrClientOffline
+	}
+	dataMap, err := Redis.HGetAll(n.key(clientId))
+	if err != nil {
+		return nil, err
+	}
+	if dataMap["node"] == "" {
+		return nil, ErrClientOffline
+	}
+	connectTime, _ := strconv.ParseInt(dataMap["connectTime"], 10, 64)
+	return &Presence{
+		ClientId:    clientId,
+		Node:        dataMap["node"],
+		Username:    dataMap["username"],
+		Ip:          dataMap["ip"],
+		ConnectTime: time.Unix(connectTime, 0),
+	}, nil
+}
+
+// 集群在线列表, 返回当前页及总数, count 不超过 presenceListMax
+func (n *Node) List(offset, count int64) ([]Presence, int64, error) {
+	if offset < 0 {
+		offset = 0
+	}
+	if count <= 0 || count > presenceListMax {
+		count = presenceListMax
+	}
+	if !Redis.IsConnected() {
+		var presenceArr []Presence
+		OnlineMap.Range(func(clientId string, conn *Connection) bool {
+			presenceArr = append(presenceArr, *n.local(clientId, conn))
+			return true
+		})
+		sort.Slice(presenceArr, func(i, j int) bool {
+			return presenceArr[i].ClientId < presenceArr[j].ClientId
+		})
+		total := int64(len(presenceArr))
+		if offset >= total {
+			return []Presence{}, total, nil
+		}
+		if count < total-offset {
+			presenceArr = presenceArr[offset : offset+count]
+		} else {
+			presenceArr = presenceArr[offset:]
+		}
+		return presenceArr, total, nil
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	total, err := Redis.ZCount(presenceKey, now, "+inf")
+	if err != nil {
+		return nil, 0, err
+	}
+	clientIdArr, err := Redis.ZRangeByScore(presenceKey, now, "+inf", offset, count)
+	if err != nil {
+		return nil, 0, err
+	}
+	presenceArr := make([]Presence, 0, len(clientIdArr))
+	for _, clientId := range clientIdArr {
+		presence, err := n.Get(clientId)
+		if err != nil {
+			continue
+		}
+		presenceArr = append(presenceArr, *presence)
+	}
+	return presenceArr, total, nil
+}
+
+func (n *Node) local(clientId string, conn *Connection) *Presence {
+	info := conn.Info()
+	return &Presence{
+		ClientId:    clientId,
+		Node:        n.Name(),
+		Username:    info.Username,
+		Ip:          info.Ip,
+		ConnectTime: info.ConnectTime,
+	}
+}
+
+// 停止刷新, 删除本节点的在线记录
+func (n *Node) Close() {
+	n.mutex.Lock()
+	if n.done != nil {
+		close(n.done)
+		n.done = nil
+	}
+	n.mutex.Unlock()
+
+	OnlineMap.Range(func(clientId string, conn *Connection) bool {
+		n.Unregister(clientId)
+		return true
+	})
+}
@@ -0,0 +1,50 @@
+package orm
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNodeNodes(t *testing.T) {
+	var n Node
+	n.Init("n1", PresenceConf{})
+	if _, err := n.Nodes("c1"); err != ErrClientOffline {
+		t.Errorf("Nodes without redis = %v, want ErrClientOffline", err)
+	}
+
+	testRedis(t)
+	live := strconv.FormatInt(time.Now().Unix()+60, 10)
+	dead := strconv.FormatInt(time.Now().Unix()-1, 10)
+	Redis.HSetMap("client:c1", map[string]string{
+		"node":        "n3",
+		"node:n3":     live,
+		"node:n2":     live,
+		"node:n4":     dead,
+		"node:n1":     live, // 本节点以 OnlineMap 为准
+		"username":    "u1",
+		"connectTime": "0",
+	})
+
+	tests := []struct {
+		clientId string
+		want     []string
+		err      error
+	}{
+		{"c1", []string{"n2", "n3"}, nil},
+		{"none", nil, ErrClientOffline},
+	}
+	for _, tt := range tests {
+		got, err := n.Nodes(tt.clientId)
+		if err != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Nodes(%s) = %v, %v, want %v, %v", tt.clientId, got, err, tt.want, tt.err)
+		}
+	}
+
+	// 全部节点过期时不在线
+	Redis.HSetMap("client:c2", map[string]string{"node": "n2", "node:n2": dead})
+	if got, err := n.Nodes("c2"); err != ErrClientOffline {
+		t.Errorf("Nodes expired = %v, %v", got, err)
+	}
+}
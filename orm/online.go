@@ -5,59 +5,174 @@ import (
 	"sync"
 )
 
+/*
+
+	本节点在线连接
+		HOST_DUPLICATE_POLICY	clientId 重复时的处理
+			reject		拒绝新连接, 默认
+			takeover	断开旧连接, 新连接接管会话
+			allow		允许多个连接, 消息发送给全部连接
+
+*/
+
+const (
+	DuplicateReject   = "reject"
+	DuplicateTakeover = "takeover"
+	DuplicateAllow    = "allow"
+)
+
 var OnlineMap Online
 
 type Online struct {
-	onlineMap sync.Map
+	mutex     sync.RWMutex
+	onlineMap map[string][]*Connection // map[clientId]连接, allow 时可以有多个
 }
 
 func (obj *Online) Clean() {
-	obj.onlineMap.Range(func(key, value interface{}) bool {
-		obj.Del(key.(string))
-		return true
-	})
+	for _, key := range obj.keys() {
+		obj.Del(key)
+	}
+}
+
+func (obj *Online) keys() []string {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	keys := make([]string, 0, len(obj.onlineMap))
+	for key := range obj.onlineMap {
+		keys = append(keys, key)
+	}
+	return keys
 }
 
+// 关闭并删除 clientId 的全部连接
 func (obj *Online) Del(key string) {
-	conn, ok := obj.onlineMap.Load(key)
-	if !ok {
-		return
+	obj.mutex.Lock()
+	connArr := obj.onlineMap[key]
+	delete(obj.onlineMap, key)
+	obj.mutex.Unlock()
+
+	for _, conn := range connArr {
+		conn.Close()
 	}
-	if conn != nil {
-		conn.(*Connection).Close()
+}
+
+// 关闭并删除指定连接, 返回 clientId 是否已没有连接
+func (obj *Online) Remove(key string, conn *Connection) bool {
+	last := obj.Unset(key, conn)
+	conn.Close()
+	return last
+}
+
+// 删除指定连接, 不关闭连接, 返回 clientId 是否已没有连接
+func (obj *Online) Unset(key string, conn *Connection) bool {
+	obj.mutex.Lock()
+	connArr := obj.onlineMap[key]
+	for i, v := range connArr {
+		if v == conn {
+			connArr = append(connArr[:i:i], connArr[i+1:]...)
+			break
+		}
 	}
-	obj.onlineMap.Delete(key)
+	if len(connArr) > 0 {
+		obj.onlineMap[key] = connArr
+	} else {
+		delete(obj.onlineMap, key)
+	}
+	obj.mutex.Unlock()
+	return len(connArr) <= 0
 }
 
+// 注册连接, clientId 已在线时返回 ErrClientExist
 func (obj *Online) Set(key string, conn *Connection) error {
 	if conn == nil {
 		return errors.New("长连接为nil")
 	}
-	if _, ok := obj.onlineMap.Load(key); ok {
-		return errors.New("长连接已注册")
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	if _, ok := obj.onlineMap[key]; ok {
+		return ErrClientExist
 	}
-	obj.onlineMap.Store(key, conn)
+	obj.init()
+	obj.onlineMap[key] = []*Connection{conn}
 	return nil
 }
 
-func (obj *Online) Exist(key string) (err error) {
-	conn, ok := obj.onlineMap.Load(key)
-	if !ok {
-		return errors.New("长连接已注销")
+// 增加连接, clientId 允许多个连接
+func (obj *Online) Add(key string, conn *Connection) error {
+	if conn == nil {
+		return errors.New("长连接为nil")
 	}
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	obj.init()
+	obj.onlineMap[key] = append(obj.onlineMap[key], conn)
+	return nil
+}
+
+// 替换连接, 返回被替换的连接
+func (obj *Online) Replace(key string, conn *Connection) ([]*Connection, error) {
 	if conn == nil {
+		return nil, errors.New("长连接为nil")
+	}
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	obj.init()
+	connArr := obj.onlineMap[key]
+	obj.onlineMap[key] = []*Connection{conn}
+	return connArr, nil
+}
+
+func (obj *Online) init() {
+	if obj.onlineMap == nil {
+		obj.onlineMap = make(map[string][]*Connection)
+	}
+}
+
+func (obj *Online) Exist(key string) (err error) {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	if len(obj.onlineMap[key]) <= 0 {
 		return errors.New("长连接已注销")
 	}
 	return nil
 }
 
+// 返回 clientId 最早的连接
 func (obj *Online) Get(key string) (conn *Connection, err error) {
-	connTmp, ok := obj.onlineMap.Load(key)
-	if !ok {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	if len(obj.onlineMap[key]) <= 0 {
 		return nil, errors.New("长连接已注销")
 	}
-	if connTmp == nil {
+	return obj.onlineMap[key][0], nil
+}
+
+// 返回 clientId 的全部连接
+func (obj *Online) GetAll(key string) ([]*Connection, error) {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	if len(obj.onlineMap[key]) <= 0 {
 		return nil, errors.New("长连接已注销")
 	}
-	return connTmp.(*Connection), nil
+	return append([]*Connection(nil), obj.onlineMap[key]...), nil
+}
+
+// 遍历在线连接, f 返回 false 时停止
+func (obj *Online) Range(f func(key string, conn *Connection) bool) {
+	obj.mutex.RLock()
+	var keyArr []string
+	var connArr []*Connection
+	for key, arr := range obj.onlineMap {
+		for _, conn := range arr {
+			keyArr = append(keyArr, key)
+			connArr = append(connArr, conn)
+		}
+	}
+	obj.mutex.RUnlock()
+
+	for i, conn := range connArr {
+		if !f(keyArr[i], conn) {
+			return
+		}
+	}
 }
@@ -0,0 +1,376 @@
+package orm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+
+	mqtt 3.1.1 报文编解码
+		固定头	类型(4位) + 标志(4位), 剩余长度(1~4字节变长)
+		支持 CONNECT PUBLISH PUBACK PUBREC PUBREL PUBCOMP SUBSCRIBE UNSUBSCRIBE PINGREQ DISCONNECT
+
+*/
+
+const (
+	PacketConnect     byte = 1
+	PacketConnack     byte = 2
+	PacketPublish     byte = 3
+	PacketPuback      byte = 4
+	PacketPubrec      byte = 5
+	PacketPubrel      byte = 6
+	PacketPubcomp     byte = 7
+	PacketSubscribe   byte = 8
+	PacketSuback      byte = 9
+	PacketUnsubscribe byte = 10
+	PacketUnsuback    byte = 11
+	PacketPingreq     byte = 12
+	PacketPingresp    byte = 13
+	PacketDisconnect  byte = 14
+
+	// connack 返回码
+	ConnackAccepted          byte = 0
+	ConnackProtocolVersion   byte = 1
+	ConnackIdentifierReject  byte = 2
+	ConnackServerUnavailable byte = 3
+	ConnackBadUsername       byte = 4
+	ConnackNotAuthorized     byte = 5
+
+	SubackFailure byte = 0x80
+
+	maxPacketSize = 1 << 20 // 报文最大长度
+)
+
+var ErrPacketMalformed = errors.New("mqtt报文格式错误")
+
+type ConnectPacket struct {
+	ProtocolName  string
+	ProtocolLevel byte
+	CleanSession  bool
+	KeepAlive     uint16
+	ClientId      string
+	WillFlag      bool
+	WillTopic     string
+	WillMessage   []byte
+	WillQos       byte
+	WillRetain    bool
+	Username      string
+	Password      string
+	HasUsername   bool
+	HasPassword   bool
+}
+
+type ConnackPacket struct {
+	SessionPresent bool
+	ReturnCode     byte
+}
+
+type PublishPacket struct {
+	Dup      bool
+	Qos      byte
+	Retain   bool
+	Topic    string
+	PacketId uint16
+	Payload  []byte
+}
+
+// PUBACK PUBREC PUBREL PUBCOMP UNSUBACK 只有报文标识
+type AckPacket struct {
+	Type     byte
+	PacketId uint16
+}
+
+type SubscribePacket struct {
+	PacketId uint16
+	Topics   []string
+	Qos      []byte
+}
+
+type SubackPacket struct {
+	PacketId    uint16
+	ReturnCodes []byte
+}
+
+type UnsubscribePacket struct {
+	PacketId uint16
+	Topics   []string
+}
+
+// PINGREQ PINGRESP DISCONNECT 只有固定头
+type EmptyPacket struct {
+	Type byte
+}
+
+// 读取一个完整报文
+func ReadPacket(r *bufio.Reader) ([]byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	lengthBytes := make([]byte, 0, 4)
+	for multiplier := 1; ; multiplier *= 128 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		lengthBytes = append(lengthBytes, b)
+		length += int(b&127) * multiplier
+		if b&128 == 0 {
+			break
+		}
+		if len(lengthBytes) >= 4 {
+			return nil, ErrPacketMalformed
+		}
+	}
+	if length > maxPacketSize {
+		return nil, errors.New("mqtt报文超出长度限制")
+	}
+
+	data := make([]byte, 1+len(lengthBytes)+length)
+	data[0] = header
+	copy(data[1:], lengthBytes)
+	if _, err := io.ReadFull(r, data[1+len(lengthBytes):]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// 解析报文, 返回 *ConnectPacket *PublishPacket *AckPacket *SubscribePacket *UnsubscribePacket *EmptyPacket
+func DecodePacket(data []byte) (interface{}, error) {
+	if len(data) < 2 {
+		return nil, ErrPacketMalformed
+	}
+	packetType := data[0] >> 4
+	flags := data[0] & 0x0f
+
+	// 跳过剩余长度
+	i := 1
+	for i < len(data) && data[i]&128 != 0 {
+		i++
+	}
+	if i >= len(data) || i > 4 {
+		return nil, ErrPacketMalformed
+	}
+	body := &packetReader{data: data[i+1:]}
+
+	switch packetType {
+	case PacketConnect:
+		return decodeConnect(body)
+	case PacketPublish:
+		p := &PublishPacket{
+			Dup:    flags&0x08 != 0,
+			Qos:    (flags >> 1) & 0x03,
+			Retain: flags&0x01 != 0,
+		}
+		if p.Qos > 2 {
+			return nil, ErrPacketMalformed
+		}
+		p.Topic = body.readString()
+		if p.Qos > 0 {
+			p.PacketId = body.readUint16()
+		}
+		p.Payload = body.rest()
+		return p, body.err
+	case PacketPuback, PacketPubrec, PacketPubrel, PacketPubcomp:
+		// PUBREL 固定头标志必须是 0x02, 其他确认报文为 0
+		reserved := byte(0)
+		if packetType == PacketPubrel {
+			reserved = 0x02
+		}
+		if flags != reserved {
+			return nil, ErrPacketMalformed
+		}
+		p := &AckPacket{Type: packetType, PacketId: body.readUint16()}
+		return p, body.err
+	case PacketSubscribe:
+		if flags != 0x02 {
+			return nil, ErrPacketMalformed
+		}
+		p := &SubscribePacket{PacketId: body.readUint16()}
+		for body.err == nil && body.len() > 0 {
+			p.Topics = append(p.Topics, body.readString())
+			qos := body.readByte()
+			// 高 6 位保留, qos 只能是 0 1 2
+			if body.err == nil && qos > 2 {
+				return nil, ErrPacketMalformed
+			}
+			p.Qos = append(p.Qos, qos)
+		}
+		if len(p.Topics) <= 0 {
+			return nil, ErrPacketMalformed
+		}
+		return p, body.err
+	case PacketUnsubscribe:
+		if flags != 0x02 {
+			return nil, ErrPacketMalformed
+		}
+		p := &UnsubscribePacket{PacketId: body.readUint16()}
+		for body.err == nil && body.len() > 0 {
+			p.Topics = append(p.Topics, body.readString())
+		}
+		if len(p.Topics) <= 0 {
+			return nil, ErrPacketMalformed
+		}
+		return p, body.err
+	case PacketPingreq, PacketDisconnect:
+		return &EmptyPacket{Type: packetType}, nil
+	}
+	return nil, errors.New("不支持的mqtt报文类型")
+}
+
+func decodeConnect(body *packetReader) (*ConnectPacket, error) {
+	p := &ConnectPacket{}
+	p.ProtocolName = body.readString()
+	p.ProtocolLevel = body.readByte()
+	flags := body.readByte()
+	p.KeepAlive = body.readUint16()
+	if body.err != nil {
+		return nil, body.err
+	}
+	if flags&0x01 != 0 {
+		return nil, ErrPacketMalformed
+	}
+	p.CleanSession = flags&0x02 != 0
+	p.WillFlag = flags&0x04 != 0
+	p.WillQos = (flags >> 3) & 0x03
+	p.WillRetain = flags&0x20 != 0
+	if p.WillQos > 2 {
+		return nil, ErrPacketMalformed
+	}
+	p.HasPassword = flags&0x40 != 0
+	p.HasUsername = flags&0x80 != 0
+
+	p.ClientId = body.readString()
+	if p.WillFlag {
+		p.WillTopic = body.readString()
+		p.WillMessage = body.readBytes()
+	}
+	if p.HasUsername {
+		p.Username = body.readString()
+	}
+	if p.HasPassword {
+		p.Password = string(body.readBytes())
+	}
+	return p, body.err
+}
+
+func (p *ConnackPacket) Encode() []byte {
+	var flags byte
+	if p.SessionPresent {
+		flags = 0x01
+	}
+	return []byte{PacketConnack << 4, 2, flags, p.ReturnCode}
+}
+
+func (p *PublishPacket) Encode() []byte {
+	header := PacketPublish<<4 | p.Qos<<1
+	if p.Dup {
+		header |= 0x08
+	}
+	if p.Retain {
+		header |= 0x01
+	}
+	body := appendString(nil, p.Topic)
+	if p.Qos > 0 {
+		body = appendUint16(body, p.PacketId)
+	}
+	body = append(body, p.Payload...)
+	return encodePacket(header, body)
+}
+
+func (p *AckPacket) Encode() []byte {
+	header := p.Type << 4
+	if p.Type == PacketPubrel {
+		header |= 0x02
+	}
+	return encodePacket(header, appendUint16(nil, p.PacketId))
+}
+
+func (p *SubackPacket) Encode() []byte {
+	body := appendUint16(nil, p.PacketId)
+	body = append(body, p.ReturnCodes...)
+	return encodePacket(PacketSuback<<4, body)
+}
+
+func (p *EmptyPacket) Encode() []byte {
+	return []byte{p.Type << 4, 0}
+}
+
+func encodePacket(header byte, body []byte) []byte {
+	data := []byte{header}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 128
+		}
+		data = append(data, b)
+		if length <= 0 {
+			break
+		}
+	}
+	return append(data, body...)
+}
+
+func appendUint16(data []byte, value uint16) []byte {
+	return append(data, byte(value>>8), byte(value))
+}
+
+func appendString(data []byte, value string) []byte {
+	data = appendUint16(data, uint16(len(value)))
+	return append(data, value...)
+}
+
+// 报文内容读取, 出错后后续读取都返回零值
+type packetReader struct {
+	data []byte
+	err  error
+}
+
+func (r *packetReader) len() int {
+	return len(r.data)
+}
+func (r *packetReader) readByte() byte {
+	if r.err != nil || len(r.data) < 1 {
+		r.err = ErrPacketMalformed
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+func (r *packetReader) readUint16() uint16 {
+	if r.err != nil || len(r.data) < 2 {
+		r.err = ErrPacketMalformed
+		return 0
+	}
+	value := binary.BigEndian.Uint16(r.data)
+	r.data = r.data[2:]
+	return value
+}
+func (r *packetReader) readBytes() []byte {
+	length := int(r.readUint16())
+	if r.err != nil || len(r.data) < length {
+		r.err = ErrPacketMalformed
+		return nil
+	}
+	value := r.data[:length]
+	r.data = r.data[length:]
+	return value
+}
+func (r *packetReader) readString() string {
+	return string(r.readBytes())
+}
+func (r *packetReader) rest() []byte {
+	if r.err != nil {
+		return nil
+	}
+	value := r.data
+	r.data = nil
+	return value
+}
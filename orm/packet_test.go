@@ -0,0 +1,186 @@
+package orm
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 固定头加剩余长度
+func rawPacket(header byte, body ...byte) []byte {
+	return encodePacket(header, body)
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet interface{ Encode() []byte }
+	}{
+		{"publish qos0", &PublishPacket{Topic: "a/b", Payload: []byte("hello")}},
+		{"publish qos1", &PublishPacket{Qos: 1, Topic: "a/b", PacketId: 1, Payload: []byte("hello")}},
+		{"publish qos2 dup retain", &PublishPacket{Dup: true, Qos: 2, Retain: true, Topic: "a", PacketId: 65535, Payload: []byte{0, 1, 2}}},
+		{"publish empty payload", &PublishPacket{Qos: 1, Topic: "t", PacketId: 2, Payload: []byte{}}},
+		{"publish large", &PublishPacket{Topic: "big", Payload: bytes.Repeat([]byte("x"), 20000)}},
+		{"puback", &AckPacket{Type: PacketPuback, PacketId: 10}},
+		{"pubrec", &AckPacket{Type: PacketPubrec, PacketId: 11}},
+		{"pubrel", &AckPacket{Type: PacketPubrel, PacketId: 12}},
+		{"pubcomp", &AckPacket{Type: PacketPubcomp, PacketId: 13}},
+		{"pingreq", &EmptyPacket{Type: PacketPingreq}},
+		{"disconnect", &EmptyPacket{Type: PacketDisconnect}},
+	}
+	for _, tt := range tests {
+		data := tt.packet.Encode()
+		read, err := ReadPacket(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			t.Errorf("%s: ReadPacket %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("%s: ReadPacket = %x, want %x", tt.name, read, data)
+			continue
+		}
+		got, err := DecodePacket(read)
+		if err != nil {
+			t.Errorf("%s: DecodePacket %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.packet) {
+			t.Errorf("%s: DecodePacket = %+v, want %+v", tt.name, got, tt.packet)
+		}
+	}
+}
+
+func TestPacketEncode(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"connack", (&ConnackPacket{SessionPresent: true, ReturnCode: ConnackAccepted}).Encode(), []byte{0x20, 2, 1, 0}},
+		{"connack refused", (&ConnackPacket{ReturnCode: ConnackNotAuthorized}).Encode(), []byte{0x20, 2, 0, 5}},
+		{"suback", (&SubackPacket{PacketId: 5, ReturnCodes: []byte{0, 1, SubackFailure}}).Encode(), []byte{0x90, 5, 0, 5, 0, 1, 0x80}},
+		{"unsuback", (&AckPacket{Type: PacketUnsuback, PacketId: 3}).Encode(), []byte{0xb0, 2, 0, 3}},
+		{"pingresp", (&EmptyPacket{Type: PacketPingresp}).Encode(), []byte{0xd0, 0}},
+		{"pubrel flags", (&AckPacket{Type: PacketPubrel, PacketId: 1}).Encode(), []byte{0x62, 2, 0, 1}},
+		{"length 127", encodePacket(0x30, make([]byte, 127))[:2], []byte{0x30, 0x7f}},
+		{"length 128", encodePacket(0x30, make([]byte, 128))[:3], []byte{0x30, 0x80, 0x01}},
+		{"length 16384", encodePacket(0x30, make([]byte, 16384))[:4], []byte{0x30, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		if !bytes.Equal(tt.data, tt.want) {
+			t.Errorf("%s: Encode = %x, want %x", tt.name, tt.data, tt.want)
+		}
+	}
+}
+
+func TestPacketDecode(t *testing.T) {
+	connect := []byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0xee, 0, 60}
+	connect = append(connect, 0, 2, 'c', '1')
+	connect = append(connect, 0, 3, 'w', '/', '1', 0, 4, 'g', 'o', 'n', 'e')
+	connect = append(connect, 0, 1, 'u', 0, 2, 'p', 'w')
+
+	tests := []struct {
+		name string
+		data []byte
+		want interface{}
+	}{
+		{
+			"connect",
+			rawPacket(PacketConnect<<4, connect...),
+			&ConnectPacket{
+				ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, KeepAlive: 60, ClientId: "c1",
+				WillFlag: true, WillTopic: "w/1", WillMessage: []byte("gone"), WillQos: 1, WillRetain: true,
+				Username: "u", Password: "pw", HasUsername: true, HasPassword: true,
+			},
+		},
+		{
+			"subscribe",
+			rawPacket(PacketSubscribe<<4|0x02, 0, 7, 0, 3, 'a', '/', '#', 1, 0, 1, '+', 2),
+			&SubscribePacket{PacketId: 7, Topics: []string{"a/#", "+"}, Qos: []byte{1, 2}},
+		},
+		{
+			"unsubscribe",
+			rawPacket(PacketUnsubscribe<<4|0x02, 0, 8, 0, 1, 'a', 0, 1, 'b'),
+			&UnsubscribePacket{PacketId: 8, Topics: []string{"a", "b"}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := DecodePacket(tt.data)
+		if err != nil {
+			t.Errorf("%s: DecodePacket %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: DecodePacket = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPacketMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"header only", []byte{0x30}},
+		{"length too long", []byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"length unterminated", []byte{0x30, 0x80}},
+		{"publish qos3", rawPacket(PacketPublish<<4|0x06, 0, 1, 'a', 0, 1)},
+		{"publish short topic", rawPacket(PacketPublish<<4, 0, 5, 'a')},
+		{"publish qos1 no id", rawPacket(PacketPublish<<4|0x02, 0, 1, 'a')},
+		{"puback short", rawPacket(PacketPuback<<4, 0)},
+		{"puback flags", rawPacket(PacketPuback<<4|0x02, 0, 1)},
+		{"pubrec flags", rawPacket(PacketPubrec<<4|0x01, 0, 1)},
+		{"pubrel flags 0", rawPacket(PacketPubrel<<4, 0, 1)},
+		{"pubrel flags 3", rawPacket(PacketPubrel<<4|0x03, 0, 1)},
+		{"pubrel flags 8", rawPacket(PacketPubrel<<4|0x0a, 0, 1)},
+		{"pubcomp flags", rawPacket(PacketPubcomp<<4|0x02, 0, 1)},
+		{"subscribe flags", rawPacket(PacketSubscribe<<4, 0, 1, 0, 1, 'a', 0)},
+		{"subscribe no topic", rawPacket(PacketSubscribe<<4|0x02, 0, 1)},
+		{"subscribe no qos", rawPacket(PacketSubscribe<<4|0x02, 0, 1, 0, 1, 'a')},
+		{"subscribe qos3", rawPacket(PacketSubscribe<<4|0x02, 0, 1, 0, 1, 'a', 3)},
+		{"subscribe reserved bits", rawPacket(PacketSubscribe<<4|0x02, 0, 1, 0, 1, 'a', 0x41)},
+		{"subscribe second qos3", rawPacket(PacketSubscribe<<4|0x02, 0, 1, 0, 1, 'a', 0, 0, 1, 'b', 3)},
+		{"unsubscribe flags", rawPacket(PacketUnsubscribe<<4, 0, 1, 0, 1, 'a')},
+		{"unsubscribe no topic", rawPacket(PacketUnsubscribe<<4|0x02, 0, 1)},
+		{"connect reserved flag", rawPacket(PacketConnect<<4, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x03, 0, 60, 0, 0)},
+		{"connect will qos3", rawPacket(PacketConnect<<4, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x1e, 0, 60, 0, 0, 0, 1, 'w', 0, 0)},
+		{"connect short", rawPacket(PacketConnect<<4, 0, 4, 'M', 'Q')},
+		{"connect no password", rawPacket(PacketConnect<<4, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x42, 0, 60, 0, 0)},
+		{"unsupported type", rawPacket(PacketConnack<<4, 0, 0)},
+	}
+	for _, tt := range tests {
+		if p, err := DecodePacket(tt.data); err == nil {
+			t.Errorf("%s: DecodePacket = %+v, want error", tt.name, p)
+		}
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	// 连续的报文按剩余长度拆分
+	stream := append((&AckPacket{Type: PacketPuback, PacketId: 1}).Encode(), (&EmptyPacket{Type: PacketPingreq}).Encode()...)
+	r := bufio.NewReader(bytes.NewReader(stream))
+	for _, want := range [][]byte{{0x40, 2, 0, 1}, {0xc0, 0}} {
+		data, err := ReadPacket(r)
+		if err != nil || !bytes.Equal(data, want) {
+			t.Errorf("ReadPacket = %x %v, want %x", data, err, want)
+		}
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"eof", nil},
+		{"truncated body", []byte{0x30, 5, 0, 1, 'a'}},
+		{"length 5 bytes", []byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"too large", []byte{0x30, 0x81, 0x80, 0x40}},
+	}
+	for _, tt := range tests {
+		if _, err := ReadPacket(bufio.NewReader(strings.NewReader(string(tt.data)))); err == nil {
+			t.Errorf("%s: ReadPacket want error", tt.name)
+		}
+	}
+}
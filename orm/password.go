@@ -0,0 +1,330 @@
+package orm
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+/*
+
+	密码哈希, 按前缀识别, 没有前缀时按明文比较
+		bcrypt	$2a$ $2b$ $2y$
+		argon2	$argon2id$v=19$m=65536,t=3,p=2$盐$哈希		盐及哈希为 base64 不补齐
+		pbkdf2	$pbkdf2-sha256$i=310000$盐$哈希			支持 sha256 sha512
+				pbkdf2_sha256$260000$盐$哈希				django 格式, 哈希为 base64
+	PASSWORD_HASH 为写入 redis 帐号时使用的算法 bcrypt argon2 pbkdf2 plain, 默认 bcrypt
+	哈希参数来自数据库, 验证前检查上限, 避免错误的记录耗尽 cpu 或内存
+	旧系统的 md5 sha1 sha256 sha512 加盐摘要见 CheckDigest, mysql 帐号使用
+
+*/
+
+const (
+	PasswordBcrypt = "bcrypt"
+	PasswordArgon2 = "argon2"
+	PasswordPbkdf2 = "pbkdf2"
+	PasswordPlain  = "plain"
+
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 2
+	pbkdf2Iter    = 310000
+	passwordSalt  = 16
+	passwordKey   = 32
+
+	// 验证时允许的参数上限
+	bcryptMaxCost    = 16
+	argon2MaxTime    = 16
+	argon2MaxMemory  = 1024 * 1024 // KiB, 1GiB
+	argon2MaxThreads = 16
+	pbkdf2MaxIter    = 5000000
+	passwordMaxSalt  = 64
+	passwordMaxKey   = 128
+)
+
+var ErrPasswordHash = errors.New("密码哈希格式错误或参数超出范围")
+
+type PasswordConf struct {
+	Hash string `env:"PASSWORD_HASH"` // 写入密码时的哈希算法
+}
+
+// 是否为支持的哈希格式
+func IsPasswordHash(value string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$", "$argon2i$", "$pbkdf2-", "pbkdf2_"} {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 按 PASSWORD_HASH 生成密码哈希, 已经是哈希的检查格式及参数后原样保存
+func HashPassword(password string) (string, error) {
+	if IsPasswordHash(password) {
+		if err := CheckPasswordHash(password); err != nil {
+			return "", err
+		}
+		return password, nil
+	}
+
+	switch Config.Password.Hash {
+	case PasswordPlain:
+		return password, nil
+	case PasswordArgon2:
+		salt, err := randomSalt()
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, passwordKey)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	case PasswordPbkdf2:
+		salt, err := randomSalt()
+		if err != nil {
+			return "", err
+		}
+		key := pbkdf2.Key([]byte(password), salt, pbkdf2Iter, passwordKey, sha256.New)
+		return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", pbkdf2Iter,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		j, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(j), nil
+	}
+}
+
+// 验证密码, 按前缀识别哈希算法, 比较均为固定时间, 哈希格式错误时返回 false
+func CheckPassword(password, hashed string) bool {
+	switch {
+	case isBcrypt(hashed):
+		if checkBcrypt(hashed) != nil {
+			return false
+		}
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+	case strings.HasPrefix(hashed, "$argon2"):
+		return checkArgon2(password, hashed)
+	case strings.HasPrefix(hashed, "$pbkdf2-"):
+		return checkPbkdf2(password, hashed)
+	case strings.HasPrefix(hashed, "pbkdf2_"):
+		return checkDjango(password, hashed)
+	}
+	// 明文, 比较摘要避免长度不同时提前返回
+	a := sha256.Sum256([]byte(password))
+	b := sha256.Sum256([]byte(hashed))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// 检查哈希的格式及参数, 不是支持的哈希格式时返回 ErrPasswordHash
+func CheckPasswordHash(hashed string) error {
+	var err error
+	switch {
+	case isBcrypt(hashed):
+		err = checkBcrypt(hashed)
+	case strings.HasPrefix(hashed, "$argon2"):
+		_, err = parseArgon2(hashed)
+	case strings.HasPrefix(hashed, "$pbkdf2-"):
+		_, err = parsePbkdf2(hashed)
+	case strings.HasPrefix(hashed, "pbkdf2_"):
+		_, err = parseDjango(hashed)
+	default:
+		err = ErrPasswordHash
+	}
+	return err
+}
+
+// 验证十六进制摘要, 如 md5(密码+盐), saltFirst 时为 md5(盐+密码), 算法不支持时返回 false
+func CheckDigest(algorithm, password, salt, hashed string, saltFirst bool) bool {
+	var h hash.Hash
+	switch algorithm {
+	case "md5":
+		h = md5.New()
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return false
+	}
+	if saltFirst {
+		h.Write([]byte(salt + password))
+	} else {
+		h.Write([]byte(password + salt))
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(hashed))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, h.Sum(nil)) == 1
+}
+
+func randomSalt() ([]byte, error) {
+	salt := make([]byte, passwordSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+func isBcrypt(hashed string) bool {
+	return strings.HasPrefix(hashed, "$2a$") || strings.HasPrefix(hashed, "$2b$") || strings.HasPrefix(hashed, "$2y$")
+}
+
+func checkBcrypt(hashed string) error {
+	cost, err := bcrypt.Cost([]byte(hashed))
+	if err != nil || cost > bcryptMaxCost {
+		return ErrPasswordHash
+	}
+	return nil
+}
+
+// 解析后的哈希参数
+type passwordHash struct {
+	name    string // argon2id argon2i 或 pbkdf2 的摘要算法
+	hash    func() hash.Hash
+	time    uint32
+	memory  uint32
+	threads uint8
+	iter    int
+	salt    []byte
+	key     []byte
+}
+
+// 盐及哈希长度检查
+func (h *passwordHash) check() error {
+	if len(h.salt) > passwordMaxSalt || len(h.key) == 0 || len(h.key) > passwordMaxKey {
+		return ErrPasswordHash
+	}
+	return nil
+}
+
+// $argon2id$v=19$m=65536,t=3,p=2$盐$哈希
+func parseArgon2(hashed string) (*passwordHash, error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 || (parts[1] != "argon2id" && parts[1] != "argon2i") {
+		return nil, ErrPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrPasswordHash
+	}
+	h := &passwordHash{name: parts[1]}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, ErrPasswordHash
+	}
+	// argon2 要求 t p 至少为 1, m 至少为 8p
+	if h.time < 1 || h.time > argon2MaxTime || h.threads < 1 || h.threads > argon2MaxThreads ||
+		h.memory < 8*uint32(h.threads) || h.memory > argon2MaxMemory {
+		return nil, ErrPasswordHash
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrPasswordHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, ErrPasswordHash
+	}
+	return h, h.check()
+}
+
+func checkArgon2(password, hashed string) bool {
+	h, err := parseArgon2(hashed)
+	if err != nil {
+		return false
+	}
+	var other []byte
+	if h.name == "argon2id" {
+		other = argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		other = argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(h.key, other) == 1
+}
+
+// $pbkdf2-sha256$i=310000$盐$哈希
+func parsePbkdf2(hashed string) (*passwordHash, error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 5 {
+		return nil, ErrPasswordHash
+	}
+	h := &passwordHash{hash: pbkdf2Hash(strings.TrimPrefix(parts[1], "pbkdf2-"))}
+	if h.hash == nil {
+		return nil, ErrPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[2], "i=%d", &h.iter); err != nil || h.iter <= 0 || h.iter > pbkdf2MaxIter {
+		return nil, ErrPasswordHash
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return nil, ErrPasswordHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrPasswordHash
+	}
+	return h, h.check()
+}
+
+func checkPbkdf2(password, hashed string) bool {
+	h, err := parsePbkdf2(hashed)
+	if err != nil {
+		return false
+	}
+	other := pbkdf2.Key([]byte(password), h.salt, h.iter, len(h.key), h.hash)
+	return subtle.ConstantTimeCompare(h.key, other) == 1
+}
+
+// django 格式 pbkdf2_sha256$260000$盐$哈希
+func parseDjango(hashed string) (*passwordHash, error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 4 {
+		return nil, ErrPasswordHash
+	}
+	h := &passwordHash{hash: pbkdf2Hash(strings.TrimPrefix(parts[0], "pbkdf2_"))}
+	if h.hash == nil {
+		return nil, ErrPasswordHash
+	}
+	var err error
+	if h.iter, err = strconv.Atoi(parts[1]); err != nil || h.iter <= 0 || h.iter > pbkdf2MaxIter {
+		return nil, ErrPasswordHash
+	}
+	h.salt = []byte(parts[2])
+	if h.key, err = base64.StdEncoding.DecodeString(parts[3]); err != nil {
+		return nil, ErrPasswordHash
+	}
+	return h, h.check()
+}
+
+func checkDjango(password, hashed string) bool {
+	h, err := parseDjango(hashed)
+	if err != nil {
+		return false
+	}
+	other := pbkdf2.Key([]byte(password), h.salt, h.iter, len(h.key), h.hash)
+	return subtle.ConstantTimeCompare(h.key, other) == 1
+}
+
+func pbkdf2Hash(name string) func() hash.Hash {
+	switch name {
+	case "sha256":
+		return sha256.New
+	case "sha512":
+		return sha512.New
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package orm
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	defer func() { Config.Password.Hash = "" }()
+	tests := []struct {
+		algorithm string
+		prefix    string
+	}{
+		{"", "$2a$"},
+		{PasswordBcrypt, "$2a$"},
+		{PasswordArgon2, "$argon2id$v=19$m=65536,t=3,p=2$"},
+		{PasswordPbkdf2, "$pbkdf2-sha256$i=310000$"},
+		{PasswordPlain, "secret"},
+	}
+	for _, tt := range tests {
+		Config.Password.Hash = tt.algorithm
+		hashed, err := HashPassword("secret")
+		if err != nil {
+			t.Errorf("%s: HashPassword %v", tt.algorithm, err)
+			continue
+		}
+		if !strings.HasPrefix(hashed, tt.prefix) {
+			t.Errorf("%s: hash %q, want prefix %q", tt.algorithm, hashed, tt.prefix)
+		}
+		if err := CheckPasswordHash(hashed); (err == nil) != (tt.algorithm != PasswordPlain) {
+			t.Errorf("%s: CheckPasswordHash %v", tt.algorithm, err)
+		}
+		if !CheckPassword("secret", hashed) {
+			t.Errorf("%s: CheckPassword failed", tt.algorithm)
+		}
+		if CheckPassword("wrong", hashed) {
+			t.Errorf("%s: CheckPassword accepted wrong password", tt.algorithm)
+		}
+		if CheckPassword("", hashed) {
+			t.Errorf("%s: CheckPassword accepted empty password", tt.algorithm)
+		}
+	}
+}
+
+// 已经是哈希的密码检查参数后保存
+func TestHashPasswordPrehashed(t *testing.T) {
+	Config.Password.Hash = PasswordArgon2
+	defer func() { Config.Password.Hash = "" }()
+
+	valid := "$pbkdf2-sha256$i=1000$c2FsdA$" + base64.RawStdEncoding.EncodeToString(pbkdf2.Key([]byte("secret"), []byte("salt"), 1000, 32, sha256.New))
+	hashed, err := HashPassword(valid)
+	if err != nil || hashed != valid {
+		t.Errorf("HashPassword(valid) = %q, %v", hashed, err)
+	}
+	for _, value := range []string{
+		"$argon2id$v=19$m=65536,t=0,p=2$c2FsdA$a2V5",
+		"$argon2id$v=19$m=4194304,t=3,p=2$c2FsdA$a2V5",
+		"$pbkdf2-sha256$i=100000000$c2FsdA$a2V5",
+		"$2a$31$abcdefghijklmnopqrstuu",
+		"$2a$",
+	} {
+		if _, err := HashPassword(value); err != ErrPasswordHash {
+			t.Errorf("HashPassword(%q) err = %v, want ErrPasswordHash", value, err)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	pbkdf2Key := func(iter int, salt string) string {
+		return base64.RawStdEncoding.EncodeToString(pbkdf2.Key([]byte("secret"), []byte(salt), iter, 32, sha256.New))
+	}
+	djangoKey := base64.StdEncoding.EncodeToString(pbkdf2.Key([]byte("secret"), []byte("salt"), 1000, 32, sha256.New))
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	salt := base64.RawStdEncoding.EncodeToString([]byte("saltsalt"))
+	argon2idKey := base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), []byte("saltsalt"), 1, 64, 1, 32))
+	argon2iKey := base64.RawStdEncoding.EncodeToString(argon2.Key([]byte("secret"), []byte("saltsalt"), 1, 64, 1, 32))
+
+	tests := []struct {
+		name   string
+		hashed string
+		valid  bool
+	}{
+		{"bcrypt", string(bcryptHash), true},
+		{"argon2id", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + argon2idKey, true},
+		{"argon2i", "$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + argon2iKey, true},
+		{"pbkdf2 sha256", "$pbkdf2-sha256$i=1000$c2FsdA$" + pbkdf2Key(1000, "salt"), true},
+		{"django", "pbkdf2_sha256$1000$salt$" + djangoKey, true},
+		{"plain", "secret", true},
+		{"plain wrong", "secret2", false},
+
+		// 参数错误或超出范围
+		{"argon2 t=0", "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + argon2idKey, false},
+		{"argon2 p=0", "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + argon2idKey, false},
+		{"argon2 p=300", "$argon2id$v=19$m=64,t=1,p=300$" + salt + "$" + argon2idKey, false},
+		{"argon2 huge m", "$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + argon2idKey, false},
+		{"argon2 huge t", "$argon2id$v=19$m=64,t=1000000,p=1$" + salt + "$" + argon2idKey, false},
+		{"argon2 version", "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + argon2idKey, false},
+		{"argon2 empty key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$", false},
+		{"argon2 bad base64", "$argon2id$v=19$m=64,t=1,p=1$!!$M2mV", false},
+		{"argon2 parts", "$argon2id$v=19$m=64,t=1,p=1$" + salt, false},
+		{"argon2d", "$argon2d$v=19$m=64,t=1,p=1$" + salt + "$" + argon2idKey, false},
+		{"pbkdf2 i=0", "$pbkdf2-sha256$i=0$c2FsdA$" + pbkdf2Key(1000, "salt"), false},
+		{"pbkdf2 huge i", "$pbkdf2-sha256$i=2000000000$c2FsdA$" + pbkdf2Key(1000, "salt"), false},
+		{"pbkdf2 md5", "$pbkdf2-md5$i=1000$c2FsdA$" + pbkdf2Key(1000, "salt"), false},
+		{"pbkdf2 long key", "$pbkdf2-sha256$i=1000$c2FsdA$" + strings.Repeat("A", 1000), false},
+		{"django huge iter", "pbkdf2_sha256$2000000000$salt$" + djangoKey, false},
+		{"django negative iter", "pbkdf2_sha256$-1$salt$" + djangoKey, false},
+		{"bcrypt cost 31", "$2a$31" + string(bcryptHash[6:]), false},
+		{"bcrypt short", "$2a$04$short", false},
+	}
+	for _, tt := range tests {
+		if got := CheckPassword("secret", tt.hashed); got != tt.valid {
+			t.Errorf("%s: CheckPassword = %v, want %v", tt.name, got, tt.valid)
+		}
+		if tt.valid && CheckPassword("wrong", tt.hashed) {
+			t.Errorf("%s: CheckPassword accepted wrong password", tt.name)
+		}
+	}
+}
+
+func TestCheckDigest(t *testing.T) {
+	md5Sum := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	sha256Sum := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	tests := []struct {
+		algorithm string
+		hashed    string
+		saltFirst bool
+		valid     bool
+	}{
+		{"md5", md5Sum("secretsalt"), false, true},
+		{"md5", md5Sum("saltsecret"), true, true},
+		{"md5", md5Sum("saltsecret"), false, false},
+		{"md5", " " + strings.ToUpper(md5Sum("secretsalt")) + "\n", false, true},
+		{"sha256", sha256Sum("saltsecret"), true, true},
+		{"sha256", md5Sum("saltsecret"), true, false},
+		{"crc32", "00", false, false},
+		{"md5", "not hex", false, false},
+	}
+	for _, tt := range tests {
+		if got := CheckDigest(tt.algorithm, "secret", "salt", tt.hashed, tt.saltFirst); got != tt.valid {
+			t.Errorf("CheckDigest(%s, %s) = %v, want %v", tt.algorithm, tt.hashed, got, tt.valid)
+		}
+	}
+}
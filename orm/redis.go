@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/gomodule/redigo/redis"
 	"log"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -16,23 +17,27 @@ type RedisConf struct {
 	Port        int64         `env:"REDIS_PORT"`
 	Password    string        `env:"REDIS_PASSWD"`
 	Db          int64         `env:"REDIS_DB"`
-	Prefix      string        `env:"REDIS_PREFIX"`       // redis 前缀 + 模块
-	MaxActive   int64         `env:"REDIS_MAX_ACTIVE"`   // 最大连接数，即最多的tcp连接数
-	MaxIdle     int64         `env:"REDIS_MAX_IDLE"`     // 最大空闲连接数，即会有这么多个连接提前等待着，但过了超时时间也会关闭。
-	IdleTimeout time.Duration `env:"REDIS_IDLE_TIMEOUT"` // 超时时间
+	Prefix      string        `env:"REDIS_PREFIX"`            // redis 前缀 + 模块
+	MaxActive   int64         `env:"REDIS_MAX_ACTIVE"`        // 最大连接数，即最多的tcp连接数
+	MaxIdle     int64         `env:"REDIS_MAX_IDLE"`          // 最大空闲连接数，即会有这么多个连接提前等待着，但过了超时时间也会关闭。
+	IdleTimeout time.Duration `env:"REDIS_IDLE_TIMEOUT"`      // 超时时间
+	Publish     string        `env:"REDIS_PUBLISH_CHANNEL"`   // 发布频道, HOST_BROKER=redis 时使用
+	Subscribe   string        `env:"REDIS_SUBSCRIBE_CHANNEL"` // 订阅频道, HOST_BROKER=redis 时使用
 }
 
 type RedisConn struct {
-	conf   RedisConf
-	conn   *redis.Pool
-	client redis.PubSubConn
-	cbMap  map[string]SubscribeCallback
+	conf    RedisConf
+	conn    *redis.Pool
+	client  redis.PubSubConn
+	cbMap   map[string]SubscribeCallback
+	cbMutex *sync.Mutex
 }
 
 func (c *RedisConn) Connect(conf RedisConf) error {
 	// 需要公司编码, 否则报错
 	log.Println("connect redis")
 	c.conf = conf
+	c.cbMutex = &sync.Mutex{}
 	// 建立连接池
 	c.conn = &redis.Pool{
 		MaxIdle:     int(c.conf.MaxIdle),
@@ -56,7 +61,15 @@ func (c *RedisConn) Connect(conf RedisConf) error {
 		},
 	}
 
-	return c.Status()
+	if err := c.Status(); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+func (c *RedisConn) IsConnected() bool {
+	return c.conn != nil
 }
 func (c *RedisConn) Close() {
 	if c.conn != nil {
@@ -133,6 +146,12 @@ func (c RedisConn) Del(key string) error {
 func (c RedisConn) Ttl(key string) (int64, error) {
 	return redis.Int64(c.exec("TTL", key))
 }
+
+// 移除过期时间
+func (c RedisConn) Persist(key string) error {
+	_, err := c.exec("PERSIST", key)
+	return err
+}
 func (c RedisConn) Expire(key string, rdExTime int64) error {
 	replay, err := redis.Int64(c.exec("Expire", key, rdExTime))
 	if err != nil {
@@ -144,7 +163,7 @@ func (c RedisConn) Expire(key string, rdExTime int64) error {
 	return nil
 }
 
-//返回所有元素
+// 返回所有元素
 func (c RedisConn) Time() ([]string, error) {
 	rc, err := c.GetConn()
 	if err != nil {
@@ -175,41 +194,79 @@ func (c RedisConn) RPop(key string) (string, error) {
 func (c RedisConn) LLen(key string) (int64, error) {
 	return redis.Int64(c.exec("LLEN", key))
 }
+func (c RedisConn) LRange(key string, start, stop int64) ([]string, error) {
+	return redis.Strings(c.exec("LRANGE", key, start, stop))
+}
+
+// 保留区间内的元素
+func (c RedisConn) LTrim(key string, start, stop int64) error {
+	_, err := c.exec("LTRIM", key, start, stop)
+	return err
+}
 
 /*
 	集合处理
 */
 
-//增加值  return int64 1 创建新值  0 值已存在
+// 增加值  return int64 1 创建新值  0 值已存在
 func (c RedisConn) SAdd(key string, val string) (int64, error) {
 	return redis.Int64(c.exec("SADD", key, val))
 }
 
-//集合长度
+// 集合长度
 func (c RedisConn) SCard(key string) (int64, error) {
 	return redis.Int64(c.exec("SCARD", key))
 }
 
-//集合移除元素  return int64 1 删除成功  0 无该值
+// 集合移除元素  return int64 1 删除成功  0 无该值
 func (c RedisConn) SRem(key string, val string) (int64, error) {
 	return redis.Int64(c.exec("SREM", key, val))
 }
 
-//随机返回一个元素
+// 随机返回一个元素
 func (c RedisConn) SRandmember(key string) (string, error) {
 	return redis.String(c.exec("SRANDMEMBER", key))
 }
 
-//返回所有元素
+// 返回所有元素
 func (c RedisConn) SMembers(key string) ([]string, error) {
 	return redis.Strings(c.exec("SMEMBERS", key))
 }
 
-//判断集合是否存在元素
+// 判断集合是否存在元素
 func (c RedisConn) SIsmember(key string, val string) (bool, error) {
 	return redis.Bool(c.exec("SISMEMBER", key, val))
 }
 
+/*
+	有序集合处理
+*/
+
+// 增加值, 已存在时更新分数
+func (c RedisConn) ZAdd(key string, score int64, member string) (int64, error) {
+	return redis.Int64(c.exec("ZADD", key, score, member))
+}
+
+// 移除元素
+func (c RedisConn) ZRem(key string, member string) (int64, error) {
+	return redis.Int64(c.exec("ZREM", key, member))
+}
+
+// 分数区间内的元素数量, min max 可使用 -inf +inf
+func (c RedisConn) ZCount(key string, min, max string) (int64, error) {
+	return redis.Int64(c.exec("ZCOUNT", key, min, max))
+}
+
+// 分数区间内的元素, 按分数排序
+func (c RedisConn) ZRangeByScore(key string, min, max string, offset, count int64) ([]string, error) {
+	return redis.Strings(c.exec("ZRANGEBYSCORE", key, min, max, "LIMIT", offset, count))
+}
+
+// 移除分数区间内的元素
+func (c RedisConn) ZRemRangeByScore(key string, min, max string) (int64, error) {
+	return redis.Int64(c.exec("ZREMRANGEBYSCORE", key, min, max))
+}
+
 /*
 	哈希处理
 */
@@ -241,7 +298,7 @@ func (c RedisConn) HKeys(key string) ([]string, error) {
 	return redis.Strings(c.exec("HKEYS", key))
 }
 
-//删除值  return int64 1 值存在并删除  0 值不存在
+// 删除值  return int64 1 值存在并删除  0 值不存在
 func (c RedisConn) HDel(key string, field string) (int64, error) {
 	return redis.Int64(c.exec("HDEL", key, field))
 }
@@ -255,23 +312,40 @@ func (c RedisConn) HLen(key string) (int64, error) {
 	return redis.Int64(c.exec("HLEN", key))
 }
 
+// 分批读取 return int64 下次的游标, 为 0 时读取完成
+func (c RedisConn) HScan(key string, cursor int64, match string, count int64) (int64, map[string]string, error) {
+	values, err := redis.Values(c.exec("HSCAN", key, cursor, "MATCH", match, "COUNT", count))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(values) != 2 {
+		return 0, nil, errors.New("HSCAN返回格式错误")
+	}
+	next, err := redis.Int64(values[0], nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	fieldsMap, err := redis.StringMap(values[1], nil)
+	return next, fieldsMap, err
+}
+
 /*
 	订阅设计
 */
 
-//发布订阅消息
-func (c RedisConn) PublicMsg(channel, msg string) bool {
+// 发布订阅消息
+func (c RedisConn) PublicMsg(channel, msg string) error {
 	conn, err := c.GetConn()
 	if err != nil {
-		return false
+		return err
 	}
 	defer conn.Close()
 
-	conn.Do("Publish", channel, msg)
-	return true
+	_, err = conn.Do("Publish", channel, msg)
+	return err
 }
 
-//订阅reids
+// 订阅reids
 func (c *RedisConn) SubConnect() (redis.Conn, error) {
 	conn, err := redis.Dial("tcp", fmt.Sprintf("%s:%v", c.conf.Host, c.conf.Port))
 	if err != nil {
@@ -293,19 +367,21 @@ func (c *RedisConn) SubConnect() (redis.Conn, error) {
 
 	return conn, nil
 }
-func (c *RedisConn) SubInit() {
+func (c *RedisConn) SubInit() error {
+	c.cbMutex.Lock()
+	defer c.cbMutex.Unlock()
 	if c.cbMap != nil {
 		//进程只有一个, 如果已经初始化了, 这里不做什么
-		return
+		return nil
 	}
 
 	conn, err := c.SubConnect()
 	if err != nil {
 		log.Println("[subscribe]", "redis sub", err.Error())
-		return
+		return err
 	}
 
-	c.client = redis.PubSubConn{conn}
+	c.client = redis.PubSubConn{Conn: conn}
 	c.cbMap = make(map[string]SubscribeCallback)
 	go func() {
 		for {
@@ -313,7 +389,12 @@ func (c *RedisConn) SubInit() {
 			case redis.Message:
 				channel := (*string)(unsafe.Pointer(&res.Channel))
 				message := (*string)(unsafe.Pointer(&res.Data))
-				c.cbMap[*channel](*message)
+				c.cbMutex.Lock()
+				cb, ok := c.cbMap[*channel]
+				c.cbMutex.Unlock()
+				if ok {
+					cb(*message)
+				}
 			case redis.Subscription:
 				log.Println("[subscribe]", "redis", res.Channel, ", 共有", res.Count, "个订阅")
 			case error:
@@ -322,19 +403,33 @@ func (c *RedisConn) SubInit() {
 				//redis 服务器出错, 10s试着重新连接
 				time.Sleep(reconnectDelay)
 				if conn, err := c.SubConnect(); err == nil {
-					c.client = redis.PubSubConn{conn}
+					c.cbMutex.Lock()
+					c.client = redis.PubSubConn{Conn: conn}
+					//重新执行订阅
+					for channel := range c.cbMap {
+						if err := c.client.Subscribe(channel); err != nil {
+							log.Println("[subscribe]", "redis", channel, err.Error())
+						}
+					}
+					c.cbMutex.Unlock()
 					log.Println("[subscribe]", "redis reconnect success")
 				}
 			}
 		}
 	}()
+	return nil
 }
-func (c *RedisConn) Subscribe(channel interface{}, cb SubscribeCallback) {
-	err := c.client.Subscribe(channel)
-	if err != nil {
+func (c *RedisConn) Subscribe(channel string, cb SubscribeCallback) error {
+	c.cbMutex.Lock()
+	defer c.cbMutex.Unlock()
+	if c.cbMap == nil {
+		return errors.New("redis订阅未初始化")
+	}
+	if err := c.client.Subscribe(channel); err != nil {
 		log.Println("redis Subscribe error.", err.Error())
-		return
+		return err
 	}
 
-	c.cbMap[channel.(string)] = cb
+	c.cbMap[channel] = cb
+	return nil
 }
@@ -0,0 +1,134 @@
+package orm
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"sync"
+)
+
+/*
+
+	保留消息, 每个主题只保留最后一条
+		redis 已连接时保存在 hash retain (topic => 消息), 否则保存在内存
+	message 为空的保留消息会清除该主题的保留消息
+	通配符订阅按主题中通配符前的部分 HSCAN 分批读取, 不整体读取 hash, 最多返回 retainMatchMax 条
+
+*/
+
+const (
+	retainKey      = "retain"
+	retainMatchMax = 1000 // 通配符订阅最多返回的保留消息数量
+	retainScan     = 100  // HSCAN 每批数量
+)
+
+var RetainMap Retain
+
+type Retain struct {
+	mutex    sync.RWMutex
+	topicMap map[string]OnelineMessage // redis 未连接时使用
+}
+
+// 保存保留消息
+func (r *Retain) Set(msg OnelineMessage) error {
+	if Redis.IsConnected() {
+		if msg.Message == "" {
+			_, err := Redis.HDel(retainKey, msg.Topic)
+			return err
+		}
+		j, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		_, err = Redis.HSet(retainKey, msg.Topic, string(j))
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if msg.Message == "" {
+		delete(r.topicMap, msg.Topic)
+		return nil
+	}
+	if r.topicMap == nil {
+		r.topicMap = make(map[string]OnelineMessage)
+	}
+	r.topicMap[msg.Topic] = msg
+	return nil
+}
+
+// 查找匹配订阅主题的保留消息
+func (r *Retain) Match(filter string) ([]OnelineMessage, error) {
+	var msgArr []OnelineMessage
+	if Redis.IsConnected() {
+		// 没有通配符直接读取
+		if CheckTopicName(filter) == nil {
+			data, err := Redis.HGet(retainKey, filter)
+			if err == redis.ErrNil {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			var msg OnelineMessage
+			if err := json.Unmarshal([]byte(data), &msg); err != nil {
+				return nil, err
+			}
+			return append(msgArr, msg), nil
+		}
+
+		match := retainPattern(filter)
+		cursor := int64(0)
+		for {
+			next, dataMap, err := Redis.HScan(retainKey, cursor, match, retainScan)
+			if err != nil {
+				return nil, err
+			}
+			for topic, data := range dataMap {
+				if !TopicMatch(filter, topic) {
+					continue
+				}
+				var msg OnelineMessage
+				if err := json.Unmarshal([]byte(data), &msg); err != nil {
+					continue
+				}
+				if len(msgArr) >= retainMatchMax {
+					return msgArr, nil
+				}
+				msgArr = append(msgArr, msg)
+			}
+			if next == 0 {
+				return msgArr, nil
+			}
+			cursor = next
+		}
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for topic, msg := range r.topicMap {
+		if len(msgArr) >= retainMatchMax {
+			break
+		}
+		if TopicMatch(filter, topic) {
+			msgArr = append(msgArr, msg)
+		}
+	}
+	return msgArr, nil
+}
+
+// 通配符前的部分作为 HSCAN 的 MATCH, 转义 glob 特殊字符
+func retainPattern(filter string) string {
+	var pattern strings.Builder
+	for _, ch := range filter {
+		if ch == '+' || ch == '#' {
+			break
+		}
+		if strings.ContainsRune(`*?[]\`, ch) {
+			pattern.WriteRune('\\')
+		}
+		pattern.WriteRune(ch)
+	}
+	pattern.WriteByte('*')
+	return pattern.String()
+}
@@ -0,0 +1,105 @@
+package orm
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func retainTopics(t *testing.T, r *Retain, filter string) []string {
+	msgArr, err := r.Match(filter)
+	if err != nil {
+		t.Fatalf("Match(%q) %v", filter, err)
+	}
+	topicArr := []string{}
+	for _, msg := range msgArr {
+		topicArr = append(topicArr, msg.Topic+"="+msg.Message)
+	}
+	sort.Strings(topicArr)
+	return topicArr
+}
+
+func testRetain(t *testing.T, r *Retain) {
+	for _, msg := range []OnelineMessage{
+		{Topic: "sensors/1/temp", Message: "10"},
+		{Topic: "sensors/2/temp", Message: "20"},
+		{Topic: "sensors/1/humidity", Message: "50"},
+		{Topic: "other", Message: "x"},
+		{Topic: "a*b/c", Message: "glob"},
+		{Topic: "sensors/1/temp", Message: "11"}, // 只保留最后一条
+	} {
+		if err := r.Set(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"sensors/1/temp", []string{"sensors/1/temp=11"}},
+		{"sensors/3/temp", []string{}},
+		{"sensors/+/temp", []string{"sensors/1/temp=11", "sensors/2/temp=20"}},
+		{"sensors/#", []string{"sensors/1/humidity=50", "sensors/1/temp=11", "sensors/2/temp=20"}},
+		{"+", []string{"other=x"}},
+		{"#", []string{"a*b/c=glob", "other=x", "sensors/1/humidity=50", "sensors/1/temp=11", "sensors/2/temp=20"}},
+		{"a*b/+", []string{"a*b/c=glob"}},
+		{"a/#", []string{}},
+	}
+	for _, tt := range tests {
+		if got := retainTopics(t, r, tt.filter); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%q) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	// 空消息清除保留消息
+	r.Set(OnelineMessage{Topic: "sensors/1/temp"})
+	r.Set(OnelineMessage{Topic: "not/exist"})
+	if got := retainTopics(t, r, "sensors/+/temp"); !reflect.DeepEqual(got, []string{"sensors/2/temp=20"}) {
+		t.Errorf("Match after clear = %v", got)
+	}
+	if got := retainTopics(t, r, "sensors/1/temp"); len(got) != 0 {
+		t.Errorf("Match cleared topic = %v", got)
+	}
+
+	// 通配符订阅返回数量有上限
+	for i := 0; i < retainMatchMax+10; i++ {
+		r.Set(OnelineMessage{Topic: "many/" + strconv.Itoa(i), Message: "m"})
+	}
+	if got := retainTopics(t, r, "many/+"); len(got) != retainMatchMax {
+		t.Errorf("Match many = %d, want %d", len(got), retainMatchMax)
+	}
+}
+
+func TestRetainMemory(t *testing.T) {
+	testRetain(t, &Retain{})
+}
+
+func TestRetainRedis(t *testing.T) {
+	mr := testRedis(t)
+	var r Retain
+	testRetain(t, &r)
+	if mr.HGet(retainKey, "sensors/2/temp") == "" {
+		t.Error("retain not saved in redis")
+	}
+}
+
+func TestRetainPattern(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{"#", "*"},
+		{"+/a", "*"},
+		{"a/b", "a/b*"},
+		{"a/+/c", "a/*"},
+		{"a/#", "a/*"},
+		{"a*?[]\\/#", "a\\*\\?\\[\\]\\\\/*"},
+	}
+	for _, tt := range tests {
+		if got := retainPattern(tt.filter); got != tt.want {
+			t.Errorf("retainPattern(%q) = %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package orm
+
+import (
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"time"
+)
+
+/*
+
+	wjt 撤销, 保存在 redis, 集群共用, key 包含 : 不能通过 /account/redis 修改
+		revoke:jti:{jti}	撤销单个 token, 保存到 token 过期
+		revoke:sub:{sub}	撤销用户在此之前签发的全部 token, 值为撤销时间, 保存 WJT_REFRESH_EXPIRE
+	refresh token 只能使用一次, 使用时写入撤销记录
+	验证及换取 token 时检查, 在线连接每 WJT_REVOKE_CHECK 秒检查一次, 撤销或过期时断开
+	撤销时间精确到秒, 同一秒内签发的 token 也会被撤销
+	未连接 redis 时不检查
+
+*/
+
+const (
+	revokeJtiKey = "revoke:jti:"
+	revokeSubKey = "revoke:sub:"
+)
+
+var Revoke RevokeStore
+
+var ErrTokenRevoked = errors.New("token已撤销")
+
+type RevokeStore struct{}
+
+// token 最长有效期, 撤销记录保存的时间
+func (r RevokeStore) maxAge() int64 {
+	expire := Token.GetRefreshExpire()
+	if expire < Token.GetExpire() {
+		expire = Token.GetExpire()
+	}
+	if expire <= 0 {
+		expire = parseExpire("", jwtRefreshExpire)
+	}
+	return int64(expire / time.Second)
+}
+
+// 撤销单个 token, expiresAt 为 token 过期时间, 为 0 时保存最长有效期
+func (r RevokeStore) RevokeToken(jti string, expiresAt int64) error {
+	if jti == "" {
+		return errors.New("jti为空")
+	}
+	if !Redis.IsConnected() {
+		return errors.New("未连接redis, 不能撤销token")
+	}
+	ttl := r.maxAge()
+	if expiresAt > 0 {
+		if ttl = expiresAt - time.Now().Unix(); ttl <= 0 {
+			// 已过期
+			return nil
+		}
+	}
+	return Redis.Set(revokeJtiKey+jti, "1", ttl)
+}
+
+// 使用一次性的 token, 原子地写入撤销记录, 已使用过时返回 false
+func (r RevokeStore) Use(jti string, expiresAt int64) (bool, error) {
+	if jti == "" {
+		return false, errors.New("jti为空")
+	}
+	if !Redis.IsConnected() {
+		return false, errors.New("未连接redis, 不能使用一次性token")
+	}
+	ttl := r.maxAge()
+	if expiresAt > 0 {
+		if ttl = expiresAt - time.Now().Unix(); ttl <= 0 {
+			return false, nil
+		}
+	}
+	_, err := redis.String(Redis.exec("SET", revokeJtiKey+jti, "1", "EX", ttl, "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 撤销用户在此之前签发的全部 token
+func (r RevokeStore) RevokeSubject(subject string) error {
+	if subject == "" {
+		return errors.New("subject为空")
+	}
+	if !Redis.IsConnected() {
+		return errors.New("未连接redis, 不能撤销token")
+	}
+	return Redis.Set(revokeSubKey+subject, strconv.FormatInt(time.Now().Unix(), 10), r.maxAge())
+}
+
+// 检查 token 是否被撤销, 撤销时返回 ErrTokenRevoked
+func (r RevokeStore) Check(jti, subject string, issuedAt int64) error {
+	if !Redis.IsConnected() {
+		return nil
+	}
+	if jti != "" {
+		flag, err := Redis.Exists(revokeJtiKey + jti)
+		if err != nil {
+			return err
+		}
+		if flag {
+			return ErrTokenRevoked
+		}
+	}
+	if subject != "" {
+		flag, err := Redis.Exists(revokeSubKey + subject)
+		if err != nil {
+			return err
+		}
+		if !flag {
+			return nil
+		}
+		value, err := Redis.Get(revokeSubKey + subject)
+		if err != nil {
+			// 检查后过期
+			return nil
+		}
+		if revokeAt, _ := strconv.ParseInt(value, 10, 64); issuedAt <= revokeAt {
+			return ErrTokenRevoked
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package orm
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+
+	持久会话 clean=false
+		session:{clientId}			hash	订阅主题 => qos
+		session:{clientId}:queue	list	离线消息, 最多保留 SESSION_QUEUE 条
+	客户端离线后会话保留 SESSION_EXPIRE 秒, 重连后恢复订阅并按顺序发送离线消息
+	依赖 redis, redis 未连接时只能使用 clean=true
+
+*/
+
+const (
+	sessionQueue  = 1000 // 默认离线消息数量
+	sessionExpire = 3600 // 默认离线会话保留时间 秒
+)
+
+var SessionMap Session
+
+type SessionConf struct {
+	Queue  int64 `env:"SESSION_QUEUE"`  // 每个客户端离线消息数量
+	Expire int64 `env:"SESSION_EXPIRE"` // 离线会话保留时间 秒
+}
+
+type Session struct {
+	mutex   sync.Mutex
+	conf    SessionConf
+	clients map[string]time.Time // map[clientId]离线时间, 在线时为零值
+}
+
+func (s *Session) Init(conf SessionConf) {
+	if conf.Queue <= 0 {
+		conf.Queue = sessionQueue
+	}
+	if conf.Expire <= 0 {
+		conf.Expire = sessionExpire
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conf = conf
+	if s.clients == nil {
+		s.clients = make(map[string]time.Time)
+	}
+}
+
+func (s *Session) key(clientId string) string {
+	return "session:" + clientId
+}
+func (s *Session) queueKey(clientId string) string {
+	return "session:" + clientId + ":queue"
+}
+
+// 打开持久会话, 返回保存的订阅
+func (s *Session) Open(clientId string) ([]Subscriber, error) {
+	if !Redis.IsConnected() {
+		return nil, errors.New("redis未连接, 不支持持久会话")
+	}
+
+	topicMap, err := Redis.HGetAll(s.key(clientId))
+	if err != nil {
+		return nil, err
+	}
+	Redis.Persist(s.key(clientId))
+	Redis.Persist(s.queueKey(clientId))
+
+	s.mutex.Lock()
+	s.clients[clientId] = time.Time{}
+	s.mutex.Unlock()
+
+	subArr := make([]Subscriber, 0, len(topicMap))
+	for topic, value := range topicMap {
+		qos, _ := strconv.ParseInt(value, 10, 64)
+		subArr = append(subArr, Subscriber{
+			ClientId: clientId,
+			Topic:    topic,
+			Qos:      qos,
+		})
+	}
+	return subArr, nil
+}
+
+// 客户端离线, 会话开始计算过期时间
+func (s *Session) Close(clientId string) {
+	s.mutex.Lock()
+	if _, ok := s.clients[clientId]; !ok {
+		s.mutex.Unlock()
+		return
+	}
+	s.clients[clientId] = time.Now()
+	expire := s.conf.Expire
+	s.mutex.Unlock()
+
+	Redis.Expire(s.key(clientId), expire)
+	Redis.Expire(s.queueKey(clientId), expire)
+}
+
+// 清理会话
+func (s *Session) Clean(clientId string) {
+	s.mutex.Lock()
+	delete(s.clients, clientId)
+	s.mutex.Unlock()
+
+	if Redis.IsConnected() {
+		Redis.Del(s.key(clientId))
+		Redis.Del(s.queueKey(clientId))
+	}
+}
+
+// 会话由其他节点接管, 只移除本地记录
+func (s *Session) Release(clientId string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.clients, clientId)
+}
+
+// 是否为持久会话
+func (s *Session) Persistent(clientId string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.clients[clientId]
+	return ok
+}
+
+// 返回离线已过期的会话, 并从本地移除
+func (s *Session) Expired() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deadline := time.Now().Add(-time.Duration(s.conf.Expire) * time.Second)
+	var clientIdArr []string
+	for clientId, offlineTime := range s.clients {
+		if !offlineTime.IsZero() && offlineTime.Before(deadline) {
+			delete(s.clients, clientId)
+			clientIdArr = append(clientIdArr, clientId)
+		}
+	}
+	return clientIdArr
+}
+
+// 保存订阅
+func (s *Session) Subscribe(clientId, topic string, qos int64) error {
+	if !s.Persistent(clientId) {
+		return nil
+	}
+	_, err := Redis.HSet(s.key(clientId), topic, strconv.FormatInt(qos, 10))
+	return err
+}
+
+// 删除订阅
+func (s *Session) Unsubscribe(clientId, topic string) error {
+	if !s.Persistent(clientId) {
+		return nil
+	}
+	_, err := Redis.HDel(s.key(clientId), topic)
+	return err
+}
+
+// 保存离线消息, 超出长度时丢弃最早的消息
+func (s *Session) Push(clientId string, msg OnelineMessage) error {
+	j, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	key := s.queueKey(clientId)
+	if _, err := Redis.RPush(key, string(j)); err != nil {
+		return err
+	}
+	if err := Redis.LTrim(key, -s.conf.Queue, -1); err != nil {
+		return err
+	}
+	return Redis.Expire(key, s.conf.Expire)
+}
+
+// 取出全部离线消息
+func (s *Session) Pop(clientId string) ([]OnelineMessage, error) {
+	key := s.queueKey(clientId)
+	var msgArr []OnelineMessage
+	for {
+		data, err := Redis.LPop(key)
+		if err == redis.ErrNil {
+			return msgArr, nil
+		}
+		if err != nil {
+			return msgArr, err
+		}
+		var msg OnelineMessage
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			continue
+		}
+		msgArr = append(msgArr, msg)
+	}
+}
@@ -0,0 +1,186 @@
+package orm
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 使用 miniredis 替代 redis, 测试结束后断开
+func testRedis(t *testing.T) *miniredis.Miniredis {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.ParseInt(s.Port(), 10, 64)
+	if err := Redis.Connect(RedisConf{Host: s.Host(), Port: port, MaxIdle: 2}); err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Redis.Close()
+		Redis = RedisConn{}
+		s.Close()
+	})
+	return s
+}
+
+func sessionTopics(subArr []Subscriber) []string {
+	topicArr := []string{}
+	for _, sub := range subArr {
+		topicArr = append(topicArr, sub.Topic+":"+strconv.FormatInt(sub.Qos, 10))
+	}
+	sort.Strings(topicArr)
+	return topicArr
+}
+
+func TestSessionNoRedis(t *testing.T) {
+	var s Session
+	s.Init(SessionConf{})
+	if _, err := s.Open("c"); err == nil {
+		t.Error("Open without redis = nil")
+	}
+	if s.Persistent("c") {
+		t.Error("Persistent after failed Open")
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	mr := testRedis(t)
+	var s Session
+	s.Init(SessionConf{Expire: 60})
+
+	subArr, err := s.Open("c")
+	if err != nil || len(subArr) != 0 {
+		t.Fatalf("Open new = %v, %v", subArr, err)
+	}
+	if !s.Persistent("c") {
+		t.Fatal("Persistent = false")
+	}
+	s.Subscribe("c", "a/#", 1)
+	s.Subscribe("c", "b", 0)
+	s.Subscribe("c", "c", 1)
+	s.Unsubscribe("c", "c")
+	// 非持久会话不保存
+	s.Subscribe("other", "a", 1)
+	if mr.Exists("session:other") {
+		t.Error("non persistent session saved")
+	}
+
+	// 离线后开始过期
+	s.Close("c")
+	if ttl := mr.TTL("session:c"); ttl != 60*time.Second {
+		t.Errorf("ttl after Close = %v", ttl)
+	}
+
+	// 重连恢复订阅, 取消过期时间
+	subArr, err = s.Open("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sessionTopics(subArr); !reflect.DeepEqual(got, []string{"a/#:1", "b:0"}) {
+		t.Errorf("restored = %v", got)
+	}
+	for _, sub := range subArr {
+		if sub.ClientId != "c" {
+			t.Errorf("restored clientId = %q", sub.ClientId)
+		}
+	}
+	if ttl := mr.TTL("session:c"); ttl != 0 {
+		t.Errorf("ttl after resume = %v", ttl)
+	}
+
+	// 清理后不再恢复
+	s.Clean("c")
+	if s.Persistent("c") || mr.Exists("session:c") {
+		t.Error("session not cleaned")
+	}
+}
+
+func TestSessionQueue(t *testing.T) {
+	mr := testRedis(t)
+	var s Session
+	s.Init(SessionConf{Queue: 3, Expire: 60})
+	if _, err := s.Open("c"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close("c")
+
+	// 超出长度时丢弃最早的消息
+	for i := 0; i < 5; i++ {
+		msg := OnelineMessage{Action: "publish", Id: strconv.Itoa(i), Topic: "a", Message: "m" + strconv.Itoa(i), Qos: 1}
+		if err := s.Push("c", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ttl := mr.TTL("session:c:queue"); ttl != 60*time.Second {
+		t.Errorf("queue ttl = %v", ttl)
+	}
+	// 无法解析的消息跳过
+	mr.Lpush("session:c:queue", "{bad")
+
+	// 重连后按顺序取出
+	if _, err := s.Open("c"); err != nil {
+		t.Fatal(err)
+	}
+	msgArr, err := s.Pop("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inflightIds(msgArr); !reflect.DeepEqual(got, []string{"2", "3", "4"}) {
+		t.Errorf("Pop = %v", got)
+	}
+	if msgArr[0].Message != "m2" || msgArr[0].Qos != 1 {
+		t.Errorf("Pop message = %+v", msgArr[0])
+	}
+	if msgArr, err := s.Pop("c"); err != nil || len(msgArr) != 0 {
+		t.Errorf("Pop again = %v, %v", msgArr, err)
+	}
+}
+
+func TestSessionExpire(t *testing.T) {
+	mr := testRedis(t)
+	var s Session
+	s.Init(SessionConf{Expire: 60})
+	s.Open("c")
+	s.Subscribe("c", "a", 1)
+	s.Push("c", OnelineMessage{Id: "1"})
+	s.Open("online")
+
+	s.Close("c")
+	if got := s.Expired(); len(got) != 0 {
+		t.Errorf("Expired before deadline = %v", got)
+	}
+
+	// 离线超过 SESSION_EXPIRE, 本地记录移除, redis 中的会话过期
+	s.mutex.Lock()
+	s.clients["c"] = time.Now().Add(-61 * time.Second)
+	s.mutex.Unlock()
+	mr.FastForward(61 * time.Second)
+	if got := s.Expired(); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("Expired = %v", got)
+	}
+	if s.Persistent("c") || !s.Persistent("online") {
+		t.Error("wrong session removed")
+	}
+	if mr.Exists("session:c") || mr.Exists("session:c:queue") {
+		t.Error("redis session not expired")
+	}
+	subArr, err := s.Open("c")
+	if err != nil || len(subArr) != 0 {
+		t.Errorf("Open expired = %v, %v", subArr, err)
+	}
+	if msgArr, _ := s.Pop("c"); len(msgArr) != 0 {
+		t.Errorf("Pop expired = %v", msgArr)
+	}
+
+	// 由其他节点接管时只移除本地记录
+	s.Subscribe("c", "b", 0)
+	s.Release("c")
+	if s.Persistent("c") || !mr.Exists("session:c") {
+		t.Error("Release removed redis session")
+	}
+}
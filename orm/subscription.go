@@ -0,0 +1,112 @@
+package orm
+
+import (
+	"sync"
+)
+
+/*
+
+	订阅注册表
+		tree		主题树, 消息分发时匹配订阅
+		clients		clientId 索引, 断开连接时清理该客户端的全部订阅
+	订阅写入后不再修改, 重复订阅替换为新的 Subscriber, 匹配结果可以在锁外安全使用
+
+*/
+
+var SubscribeMap Subscription
+
+type Subscriber struct {
+	ClientId string // 客户端
+	Topic    string // 订阅主题, 可包含通配符
+	Qos      int64  // 订阅的最大 qos
+}
+
+type Subscription struct {
+	mutex   sync.Mutex
+	tree    TopicTree
+	clients map[string]map[string]*Subscriber // map[clientId]map[topic]
+}
+
+// 添加订阅
+func (s *Subscription) Add(clientId, topic string, qos int64) error {
+	sub := &Subscriber{
+		ClientId: clientId,
+		Topic:    topic,
+		Qos:      qos,
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.tree.Add(sub); err != nil {
+		return err
+	}
+	if s.clients == nil {
+		s.clients = make(map[string]map[string]*Subscriber)
+	}
+	topicMap, ok := s.clients[clientId]
+	if !ok {
+		topicMap = make(map[string]*Subscriber)
+		s.clients[clientId] = topicMap
+	}
+	topicMap[topic] = sub
+	return nil
+}
+
+// 删除订阅
+func (s *Subscription) Remove(clientId, topic string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.tree.Delete(topic, clientId)
+	if topicMap, ok := s.clients[clientId]; ok {
+		delete(topicMap, topic)
+		if len(topicMap) <= 0 {
+			delete(s.clients, clientId)
+		}
+	}
+}
+
+// 删除客户端的全部订阅
+func (s *Subscription) RemoveClient(clientId string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	topicMap, ok := s.clients[clientId]
+	if !ok {
+		return
+	}
+	for topic := range topicMap {
+		s.tree.Delete(topic, clientId)
+	}
+	delete(s.clients, clientId)
+}
+
+// 匹配主题的订阅, map[clientId]*Subscriber
+func (s *Subscription) Match(topic string) map[string]*Subscriber {
+	return s.tree.Match(topic)
+}
+
+// 客户端已订阅的主题
+func (s *Subscription) Topics(clientId string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	topics := make([]string, 0, len(s.clients[clientId]))
+	for topic := range s.clients[clientId] {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// 客户端的全部订阅
+func (s *Subscription) Subscribers(clientId string) []Subscriber {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	subArr := make([]Subscriber, 0, len(s.clients[clientId]))
+	for _, sub := range s.clients[clientId] {
+		subArr = append(subArr, *sub)
+	}
+	return subArr
+}
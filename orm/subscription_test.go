@@ -0,0 +1,148 @@
+package orm
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func subscriptionTopics(s *Subscription, clientId string) []string {
+	topicArr := s.Topics(clientId)
+	sort.Strings(topicArr)
+	return topicArr
+}
+
+// 匹配到的 clientId => qos
+func subscriptionMatch(s *Subscription, topic string) map[string]int64 {
+	qosMap := make(map[string]int64)
+	for clientId, sub := range s.Match(topic) {
+		qosMap[clientId] = sub.Qos
+	}
+	return qosMap
+}
+
+func TestSubscriptionAdd(t *testing.T) {
+	var s Subscription
+	if got := s.Topics("c1"); len(got) != 0 {
+		t.Errorf("empty Topics = %v", got)
+	}
+
+	tests := []struct {
+		clientId string
+		topic    string
+		qos      int64
+		valid    bool
+	}{
+		{"c1", "a/b", 0, true},
+		{"c1", "a/#", 1, true},
+		{"c2", "a/+", 1, true},
+		{"c1", "a/b", 1, true}, // 重复订阅替换 qos
+		{"c2", "a/#/b", 0, false},
+		{"c2", "", 0, false},
+	}
+	for _, tt := range tests {
+		if err := s.Add(tt.clientId, tt.topic, tt.qos); (err == nil) != tt.valid {
+			t.Errorf("Add(%s, %q) = %v, want valid %v", tt.clientId, tt.topic, err, tt.valid)
+		}
+	}
+
+	if got := subscriptionTopics(&s, "c1"); !reflect.DeepEqual(got, []string{"a/#", "a/b"}) {
+		t.Errorf("Topics c1 = %v", got)
+	}
+	if got := subscriptionTopics(&s, "c2"); !reflect.DeepEqual(got, []string{"a/+"}) {
+		t.Errorf("Topics c2 = %v", got)
+	}
+	if got := subscriptionMatch(&s, "a/b"); !reflect.DeepEqual(got, map[string]int64{"c1": 1, "c2": 1}) {
+		t.Errorf("Match a/b = %v", got)
+	}
+	if got := subscriptionMatch(&s, "a/b/c"); !reflect.DeepEqual(got, map[string]int64{"c1": 1}) {
+		t.Errorf("Match a/b/c = %v", got)
+	}
+	subArr := s.Subscribers("c2")
+	if len(subArr) != 1 || subArr[0] != (Subscriber{ClientId: "c2", Topic: "a/+", Qos: 1}) {
+		t.Errorf("Subscribers c2 = %+v", subArr)
+	}
+}
+
+func TestSubscriptionRemove(t *testing.T) {
+	var s Subscription
+	s.Add("c1", "a/b", 0)
+	s.Add("c1", "a/#", 1)
+	s.Add("c2", "a/b", 1)
+
+	s.Remove("c1", "a/b")
+	s.Remove("c1", "not/exist")
+	s.Remove("none", "a/b")
+	if got := subscriptionTopics(&s, "c1"); !reflect.DeepEqual(got, []string{"a/#"}) {
+		t.Errorf("Topics after Remove = %v", got)
+	}
+	// 其他订阅仍然匹配
+	if got := subscriptionMatch(&s, "a/b"); !reflect.DeepEqual(got, map[string]int64{"c1": 1, "c2": 1}) {
+		t.Errorf("Match after Remove = %v", got)
+	}
+
+	// 最后一个订阅删除后清理客户端索引
+	s.Remove("c1", "a/#")
+	if _, ok := s.clients["c1"]; ok {
+		t.Error("empty client not removed")
+	}
+	if got := subscriptionMatch(&s, "a/b"); !reflect.DeepEqual(got, map[string]int64{"c2": 1}) {
+		t.Errorf("Match after remove all = %v", got)
+	}
+}
+
+// 断开连接时清理客户端的全部订阅
+func TestSubscriptionRemoveClient(t *testing.T) {
+	var s Subscription
+	s.Add("c1", "a/b", 0)
+	s.Add("c1", "a/+", 1)
+	s.Add("c1", "#", 1)
+	s.Add("c2", "a/b", 0)
+
+	s.RemoveClient("c1")
+	s.RemoveClient("none")
+	if got := s.Topics("c1"); len(got) != 0 {
+		t.Errorf("Topics after RemoveClient = %v", got)
+	}
+	if got := s.Subscribers("c1"); len(got) != 0 {
+		t.Errorf("Subscribers after RemoveClient = %v", got)
+	}
+	if got := subscriptionMatch(&s, "a/b"); !reflect.DeepEqual(got, map[string]int64{"c2": 0}) {
+		t.Errorf("Match after RemoveClient = %v", got)
+	}
+	if got := subscriptionMatch(&s, "x"); len(got) != 0 {
+		t.Errorf("Match # after RemoveClient = %v", got)
+	}
+	if _, ok := s.tree.root.children["#"]; ok {
+		t.Error("empty node # not removed")
+	}
+
+	// 清理后可以重新订阅
+	s.Add("c1", "a/b", 1)
+	if got := subscriptionMatch(&s, "a/b"); !reflect.DeepEqual(got, map[string]int64{"c1": 1, "c2": 0}) {
+		t.Errorf("Match after resubscribe = %v", got)
+	}
+}
+
+func TestSubscriptionConcurrent(t *testing.T) {
+	var s Subscription
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(clientId string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Add(clientId, "a/+", 1)
+				s.Match("a/b")
+				s.Topics(clientId)
+				s.RemoveClient(clientId)
+			}
+		}("c" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	if got := s.Match("a/b"); len(got) != 0 {
+		t.Errorf("Match after concurrent = %v", got)
+	}
+}
@@ -1,55 +1,194 @@
 package orm
 
 import (
+	"crypto"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"github.com/dgrijalva/jwt-go"
+	"log"
+	"strconv"
 	"strings"
 	"time"
 )
 
+/*
+
+	wjt 签发及验证, 每次签发单独生成 claims, 初始化后只读, 可以并发使用
+		access	连接验证使用, 有效期 WJT_EXPIRE
+		refresh	只能用于 /account/wjt/refresh 换取新的 token, 有效期 WJT_REFRESH_EXPIRE
+				只能使用一次, 需要 redis 记录, 换取的 refresh token 沿用原来的过期时间
+	验证及换取时检查是否被撤销, 见 revoke.go
+	WJT_AUDIENCE 不为空时, 签发时默认使用并在验证时校验
+	WJT_ALGORITHM 为签名算法, 默认 HS256 使用 WJT_SECRET, 非对称签名见 jwks.go
+	非调试模式不能使用默认密钥, 只接受 WJT_ALGORITHM 同类的签名算法, 非对称签名时忽略 WJT_SECRET
+
+*/
+
 const (
-	//未设置密钥有效期， 默认设置
-	jwtKey    = "aabbccddeeffgg00112233445566"
-	jwtExpire = "5m"
-	jwtIssuer = "gin-issuer"
+	//未设置密钥有效期， 默认设置, 默认密钥只能在调试模式使用
+	jwtKey           = "aabbccddeeffgg00112233445566"
+	jwtExpire        = "5m"
+	jwtRefreshExpire = "168h"
+	jwtIssuer        = "gin-issuer"
+
+	TokenAccess  = "access"
+	TokenRefresh = "refresh"
 )
 
 var Token JWT
 
 type WJTConf struct {
-	Secret string `env:"WJT_SECRET"`
-	Expir  string `env:"WJT_EXPIRE"`
-	Issuer string `env:"WJT_ISSUER"`
+	Secret        string `env:"WJT_SECRET"`
+	Expir         string `env:"WJT_EXPIRE"`
+	RefreshExpire string `env:"WJT_REFRESH_EXPIRE"`
+	Issuer        string `env:"WJT_ISSUER"`
+	Audience      string `env:"WJT_AUDIENCE"`
+	Algorithm     string `env:"WJT_ALGORITHM"`    // 签名算法 HS256 RS256 ES256 EdDSA 等
+	PrivateKey    string `env:"WJT_PRIVATE_KEY"`  // 签名私钥 pem 文件
+	KeyId         string `env:"WJT_KEY_ID"`       // 签名私钥的 kid, 默认为文件名
+	PublicKeys    string `env:"WJT_PUBLIC_KEYS"`  // 验证公钥 pem 文件, 逗号分隔
+	JwksUrl       string `env:"WJT_JWKS_URL"`     // jwks 地址
+	JwksCache     int64  `env:"WJT_JWKS_CACHE"`   // jwks 缓存时间(秒), 默认 300
+	RevokeCheck   int64  `env:"WJT_REVOKE_CHECK"` // 在线连接 token 检查间隔(秒), 默认 10
 }
 
 //加密主体, 根据实际情况修改
 type Claims struct {
-	ID int64
+	ID       int64
+	Type     string                 `json:"type,omitempty"`     // access refresh
+	Username string                 `json:"username,omitempty"` // 帐号, 为空时使用 sub
+	Roles    []string               `json:"roles,omitempty"`    // 角色
+	Topics   []string               `json:"topics,omitempty"`   // 允许发布及订阅的主题
+	Acl      []AclRule              `json:"acl,omitempty"`      // 主题权限
+	Custom   map[string]interface{} `json:"custom,omitempty"`   // 自定义内容
 	jwt.StandardClaims
 }
 
+// 用户id, 为 sub, 为空时使用 ID
+func (c Claims) UserId() string {
+	if c.Subject != "" {
+		return c.Subject
+	}
+	return strconv.FormatInt(c.ID, 10)
+}
+
+// 签发的 token
+type TokenPair struct {
+	AccessToken      string `json:"accessToken"`
+	ExpiresAt        int64  `json:"expiresAt"`
+	RefreshToken     string `json:"refreshToken"`
+	RefreshExpiresAt int64  `json:"refreshExpiresAt"`
+}
+
 //处理结构
 type JWT struct {
-	Claims    Claims
-	expire    string
-	jwtSecret []byte
+	expire        time.Duration
+	refreshExpire time.Duration
+	issuer        string
+	audience      string
+	jwtSecret     []byte
+	method        jwt.SigningMethod
+	privateKey    crypto.Signer
+	keyId         string
+	keys          map[string]crypto.PublicKey // map[kid]公钥
+	jwks          *jwksCache
 }
 
-func (obj *JWT) Init(conf WJTConf) {
+func (obj *JWT) Init(conf WJTConf) error {
 	obj.SetSecret([]byte(conf.Secret))
 	obj.SetExpire(conf.Expir)
+	obj.SetRefreshExpire(conf.RefreshExpire)
 	obj.SetIssuer(conf.Issuer)
+	obj.audience = conf.Audience
+
+	obj.method = jwt.SigningMethodHS256
+	if conf.Algorithm != "" {
+		if obj.method = jwt.GetSigningMethod(conf.Algorithm); obj.method == nil {
+			return errors.New("不支持的签名算法#" + conf.Algorithm)
+		}
+	}
+
+	obj.keys = make(map[string]crypto.PublicKey)
+	obj.privateKey, obj.keyId, obj.jwks = nil, "", nil
+	for _, file := range splitList(conf.PublicKeys) {
+		key, err := LoadPublicKey(file)
+		if err != nil {
+			return err
+		}
+		obj.keys[keyIdFromFile(file)] = key
+	}
+	if conf.PrivateKey != "" {
+		key, err := LoadPrivateKey(conf.PrivateKey)
+		if err != nil {
+			return err
+		}
+		obj.privateKey = key
+		obj.keyId = conf.KeyId
+		if obj.keyId == "" {
+			obj.keyId = keyIdFromFile(conf.PrivateKey)
+		}
+		obj.keys[obj.keyId] = key.Public()
+	}
+	if conf.JwksUrl != "" {
+		cache := conf.JwksCache
+		if cache <= 0 {
+			cache = 300
+		}
+		obj.jwks = newJwksCache(conf.JwksUrl, time.Duration(cache)*time.Second)
+	}
+
+	if !obj.hmac() {
+		// 非对称签名不使用 WJT_SECRET, 避免伪造 HS256 的 token
+		obj.jwtSecret = nil
+	} else if string(obj.jwtSecret) == jwtKey || len(obj.jwtSecret) == 0 {
+		if !Config.Debug {
+			return errors.New("请设置WJT_SECRET, 非调试模式不能使用默认密钥")
+		}
+		log.Println("[wjt] 使用默认密钥, 只能用于调试")
+		obj.jwtSecret = []byte(jwtKey)
+	}
+	if !obj.hmac() && obj.privateKey == nil {
+		log.Println("[wjt] 未设置WJT_PRIVATE_KEY, 只能验证token")
+	}
+	return nil
+}
+
+// 签名算法是否为 HS256 等
+func (obj JWT) hmac() bool {
+	_, ok := obj.method.(*jwt.SigningMethodHMAC)
+	return ok
+}
+
+// 签名算法类别, 同类算法使用相同类型的密钥
+func methodFamily(method jwt.SigningMethod) string {
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return "hmac"
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		return "rsa"
+	case *jwt.SigningMethodECDSA:
+		return "ecdsa"
+	case *signingMethodEd25519:
+		return "eddsa"
+	}
+	return ""
 }
 
 // wjt 有效期   m 分钟    h  小时   s   秒
 // 300s
-func (obj *JWT) SetExpire(Expire string) {
-	obj.expire = Expire
+func (obj *JWT) SetExpire(expire string) {
+	obj.expire = parseExpire(expire, jwtExpire)
 }
-func (obj *JWT) GetExpire() time.Time {
-	return time.Unix(obj.Claims.StandardClaims.ExpiresAt, 0)
+func (obj *JWT) GetExpire() time.Duration {
+	return obj.expire
+}
+
+func (obj *JWT) SetRefreshExpire(expire string) {
+	obj.refreshExpire = parseExpire(expire, jwtRefreshExpire)
+}
+func (obj *JWT) GetRefreshExpire() time.Duration {
+	return obj.refreshExpire
 }
 
 func (obj *JWT) SetSecret(secret []byte) {
@@ -60,31 +199,147 @@ func (obj *JWT) GetSecret() []byte {
 }
 
 func (obj *JWT) SetIssuer(issuer string) {
-	obj.Claims.Issuer = issuer
+	if issuer == "" {
+		issuer = jwtIssuer
+	}
+	obj.issuer = issuer
 }
 func (obj *JWT) GetIssuer() string {
-	return obj.Claims.Issuer
+	return obj.issuer
 }
 
-// 生成token
-func (obj *JWT) GenerateToken() (string, error) {
+func parseExpire(expire, def string) time.Duration {
+	if m, err := time.ParseDuration(expire); err == nil && m > 0 {
+		return m
+	}
+	m, _ := time.ParseDuration(def)
+	return m
+}
+
+// 签发 access 及 refresh token
+func (obj JWT) Issue(claims Claims) (*TokenPair, error) {
+	now := time.Now()
+	return obj.issue(claims, now, now.Add(obj.refreshExpire))
+}
 
-	if len(obj.jwtSecret) == 0 {
-		obj.SetSecret([]byte(jwtKey))
+// access token 有效期不超过 refresh token
+func (obj JWT) issue(claims Claims, now, refreshExpiresAt time.Time) (*TokenPair, error) {
+	refreshExpire := refreshExpiresAt.Sub(now)
+	expire := obj.expire
+	if expire <= 0 || expire > refreshExpire {
+		expire = refreshExpire
 	}
-	if obj.expire == "" {
-		obj.SetExpire(jwtExpire)
+	claims.Type = TokenAccess
+	access, expiresAt, err := obj.sign(claims, now, expire)
+	if err != nil {
+		return nil, err
 	}
-	if obj.Claims.Issuer == "" {
-		obj.Claims.Issuer = jwtIssuer
+	claims.Type = TokenRefresh
+	refresh, refreshExpiresAtUnix, err := obj.sign(claims, now, refreshExpire)
+	if err != nil {
+		return nil, err
 	}
+	return &TokenPair{
+		AccessToken:      access,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refresh,
+		RefreshExpiresAt: refreshExpiresAtUnix,
+	}, nil
+}
 
-	m, _ := time.ParseDuration(obj.expire)
-	obj.Claims.StandardClaims.ExpiresAt = time.Now().Add(m).Unix()
-	obj.Claims.IssuedAt = time.Now().Unix()
+// 生成 access token
+func (obj JWT) GenerateToken(claims Claims) (string, error) {
+	claims.Type = TokenAccess
+	token, _, err := obj.sign(claims, time.Now(), obj.expire)
+	return token, err
+}
 
-	tokenClaims := jwt.NewWithClaims(jwt.SigningMethodHS256, obj.Claims)
-	return tokenClaims.SignedString(obj.jwtSecret)
+// 使用 refresh token 签发新的 token, refresh token 只能使用一次
+// 新的 refresh token 沿用原来的过期时间, 不能无限续期
+func (obj JWT) Refresh(token string) (*TokenPair, error) {
+	claims, err := obj.ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Type != TokenRefresh {
+		return nil, errors.New("请使用refresh token")
+	}
+	if err := Revoke.Check(claims.Id, claims.UserId(), claims.IssuedAt); err != nil {
+		return nil, err
+	}
+	used, err := Revoke.Use(claims.Id, claims.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if !used {
+		return nil, ErrTokenRevoked
+	}
+
+	now := time.Now()
+	refreshExpiresAt := time.Unix(claims.ExpiresAt, 0)
+	if !refreshExpiresAt.After(now) {
+		return nil, errors.New("refresh token已过期")
+	}
+	return obj.issue(*claims, now, refreshExpiresAt)
+}
+
+func (obj JWT) sign(claims Claims, now time.Time, expire time.Duration) (string, int64, error) {
+	if expire <= 0 {
+		expire = parseExpire("", jwtExpire)
+	}
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(expire).Unix()
+	claims.Id = NewMessageId()
+	if claims.Issuer == "" {
+		claims.Issuer = obj.issuer
+	}
+	if claims.Audience == "" {
+		claims.Audience = obj.audience
+	}
+
+	method := obj.method
+	if method == nil {
+		method = jwt.SigningMethodHS256
+	}
+	tokenClaims := jwt.NewWithClaims(method, claims)
+	var key interface{} = obj.jwtSecret
+	if _, ok := method.(*jwt.SigningMethodHMAC); !ok {
+		if obj.privateKey == nil {
+			return "", 0, errors.New("未设置WJT_PRIVATE_KEY, 不能签发token")
+		}
+		key = obj.privateKey
+		tokenClaims.Header["kid"] = obj.keyId
+	} else if len(obj.jwtSecret) == 0 {
+		return "", 0, errors.New("未设置WJT_SECRET, 不能签发token")
+	}
+	token, err := tokenClaims.SignedString(key)
+	return token, claims.ExpiresAt, err
+}
+
+// 按签名算法及 kid 查找验证密钥
+func (obj JWT) verifyKey(token *jwt.Token) (interface{}, error) {
+	method := obj.method
+	if method == nil {
+		method = jwt.SigningMethodHS256
+	}
+	// 只接受 WJT_ALGORITHM 同类的签名算法
+	if methodFamily(token.Method) != methodFamily(method) {
+		return nil, errors.New("token签名方式错误")
+	}
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(obj.jwtSecret) == 0 {
+			return nil, errors.New("token签名方式错误")
+		}
+		return obj.jwtSecret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	if key := findKey(obj.keys, kid, token.Method); key != nil {
+		return key, nil
+	}
+	if obj.jwks != nil {
+		return obj.jwks.find(kid, token.Method)
+	}
+	return nil, errors.New("token kid错误")
 }
 
 // 验证token
@@ -92,15 +347,19 @@ func (obj JWT) ParseToken(token string) (*Claims, error) {
 	if token == "" {
 		return nil, errors.New("token为空")
 	}
-	tokenClaims, err := jwt.ParseWithClaims(token, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return obj.jwtSecret, nil
-	})
+	tokenClaims, err := jwt.ParseWithClaims(token, &Claims{}, obj.verifyKey)
 
 	if tokenClaims != nil {
 		if claims, ok := tokenClaims.Claims.(*Claims); ok && tokenClaims.Valid {
+			if obj.audience != "" && !claims.VerifyAudience(obj.audience, true) {
+				return nil, errors.New("token audience错误")
+			}
 			return claims, nil
 		}
 	}
+	if err == nil {
+		err = errors.New("token无效")
+	}
 	return nil, err
 }
 
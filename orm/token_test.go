@@ -0,0 +1,206 @@
+package orm
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 本地 jwks 服务
+func jwksServer(t *testing.T, keys ...map[string]string) *httptest.Server {
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+}
+
+func ecJwk(kid string, key *ecdsa.PublicKey) map[string]string {
+	pad := func(b []byte) string {
+		out := make([]byte, 32)
+		copy(out[32-len(b):], b)
+		return base64.RawURLEncoding.EncodeToString(out)
+	}
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": pad(key.X.Bytes()), "y": pad(key.Y.Bytes())}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	claims := Claims{Type: TokenAccess}
+	claims.Subject = "u1"
+	claims.ExpiresAt = time.Now().Add(time.Minute).Unix()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestTokenJwks(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	server := jwksServer(t,
+		ecJwk("ec1", &ecKey.PublicKey),
+		map[string]string{"kty": "OKP", "kid": "ed1", "crv": "Ed25519", "x": base64.RawURLEncoding.EncodeToString(edPublic)},
+	)
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		algorithm string
+		token     string
+		valid     bool
+	}{
+		{"es256", "ES256", signToken(t, jwt.SigningMethodES256, "ec1", ecKey), true},
+		{"es256 no kid", "ES256", signToken(t, jwt.SigningMethodES256, "", ecKey), true},
+		{"es256 unknown kid", "ES256", signToken(t, jwt.SigningMethodES256, "ec2", ecKey), false},
+		{"es256 wrong key", "ES256", signToken(t, jwt.SigningMethodES256, "ec1", otherKey), false},
+		{"eddsa", "EdDSA", signToken(t, SigningMethodEdDSA, "ed1", edPrivate), true},
+		{"eddsa configured es256", "ES256", signToken(t, SigningMethodEdDSA, "ed1", edPrivate), false},
+		{"hs256 with default secret", "ES256", signToken(t, jwt.SigningMethodHS256, "", []byte(jwtKey)), false},
+		{"hs256 kid of public key", "ES256", signToken(t, jwt.SigningMethodHS256, "ec1", []byte(jwtKey)), false},
+	}
+	for _, tt := range tests {
+		var obj JWT
+		err := obj.Init(WJTConf{Secret: jwtKey, Algorithm: tt.algorithm, JwksUrl: server.URL})
+		if err != nil {
+			t.Fatalf("%s: Init %v", tt.name, err)
+		}
+		claims, err := obj.ParseToken(tt.token)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: ParseToken err = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+		if err == nil && claims.Subject != "u1" {
+			t.Errorf("%s: subject = %q", tt.name, claims.Subject)
+		}
+	}
+}
+
+// 获取 jwks 时不持有锁, 并发的调用只请求一次
+func TestJwksRefresh(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	data, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{ecJwk("ec1", &ecKey.PublicKey)}})
+	var count int32
+	started := make(chan bool, 10)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		started <- true
+		<-release
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	cache := newJwksCache(server.URL, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.find("ec1", jwt.SigningMethodES256); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	<-started
+
+	locked := make(chan bool)
+	go func() {
+		cache.mutex.RLock()
+		cache.mutex.RUnlock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("lock held during fetch")
+	}
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&count); n != 1 {
+		t.Errorf("requests = %d, want 1", n)
+	}
+}
+
+func TestTokenPem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wjt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	privateFile := filepath.Join(dir, "rsa1.pem")
+	privateData := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	if err := ioutil.WriteFile(privateFile, privateData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	publicBytes, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	publicFile := filepath.Join(dir, "rsa1.pub")
+	if err := ioutil.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// 私钥签发及验证
+	var issuer JWT
+	if err := issuer.Init(WJTConf{Secret: jwtKey, Algorithm: "RS256", PrivateKey: privateFile}); err != nil {
+		t.Fatal(err)
+	}
+	token, err := issuer.GenerateToken(Claims{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuer.ParseToken(token); err != nil {
+		t.Errorf("issuer ParseToken %v", err)
+	}
+
+	// 只配置公钥验证, kid 为文件名
+	var verifier JWT
+	if err := verifier.Init(WJTConf{Algorithm: "RS256", PublicKeys: publicFile}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.ParseToken(token); err != nil {
+		t.Errorf("verifier ParseToken %v", err)
+	}
+	if _, err := verifier.ParseToken(signToken(t, jwt.SigningMethodHS256, "rsa1", []byte(jwtKey))); err == nil {
+		t.Error("verifier accepted hs256 token")
+	}
+	if _, err := verifier.GenerateToken(Claims{ID: 1}); err == nil {
+		t.Error("verifier issued token without private key")
+	}
+
+	// HS256 不接受 RS256 的 token
+	Config.Debug = true
+	defer func() { Config.Debug = false }()
+	var hmac JWT
+	if err := hmac.Init(WJTConf{Secret: "secret", PublicKeys: publicFile}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hmac.ParseToken(token); err == nil {
+		t.Error("hs256 accepted rs256 token")
+	}
+}
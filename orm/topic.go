@@ -0,0 +1,199 @@
+package orm
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+/*
+
+	主题树, 兼容 mqtt 通配符
+		+	匹配单层		sensors/+/temp
+		#	匹配多层, 只能出现在最后一层	sensors/#
+	以 $ 开头的主题(如 $SYS)不会被首层通配符匹配
+	$SYS/ 开头的系统主题客户端只能订阅, 不能发布
+
+*/
+
+const (
+	topicSeparator   = "/"
+	topicSingleLevel = "+"
+	topicMultiLevel  = "#"
+
+	SysTopicPrefix = "$SYS/" // 系统主题, 只能由服务端发布
+)
+
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[string]*Subscriber // map[clientId]订阅
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:    make(map[string]*topicNode),
+		subscribers: make(map[string]*Subscriber),
+	}
+}
+
+type TopicTree struct {
+	mutex sync.RWMutex
+	root  *topicNode
+}
+
+// 订阅主题校验, 允许通配符
+func CheckTopicFilter(filter string) error {
+	if filter == "" {
+		return errors.New("topic为空")
+	}
+	levels := strings.Split(filter, topicSeparator)
+	for i, level := range levels {
+		switch {
+		case level == topicMultiLevel:
+			if i != len(levels)-1 {
+				return errors.New("topic通配符#只能在最后一层")
+			}
+		case level == topicSingleLevel:
+		case strings.ContainsAny(level, topicSingleLevel+topicMultiLevel):
+			return errors.New("topic通配符必须占据整层")
+		}
+	}
+	return nil
+}
+
+// 发布主题校验, 不允许通配符
+func CheckTopicName(topic string) error {
+	if topic == "" {
+		return errors.New("topic为空")
+	}
+	if strings.ContainsAny(topic, topicSingleLevel+topicMultiLevel) {
+		return errors.New("发布的topic不能包含通配符")
+	}
+	return nil
+}
+
+// 是否为系统主题
+func IsSysTopic(topic string) bool {
+	return strings.HasPrefix(topic, SysTopicPrefix)
+}
+
+// 判断主题是否匹配订阅主题
+func TopicMatch(filter, topic string) bool {
+	filterLevels := strings.Split(filter, topicSeparator)
+	topicLevels := strings.Split(topic, topicSeparator)
+	if strings.HasPrefix(topic, "$") && len(filterLevels) > 0 &&
+		(filterLevels[0] == topicSingleLevel || filterLevels[0] == topicMultiLevel) {
+		return false
+	}
+	for i, level := range filterLevels {
+		if level == topicMultiLevel {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != topicSingleLevel && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// 添加订阅, 同一个 clientId 重复订阅同一主题会覆盖
+func (t *TopicTree) Add(sub *Subscriber) error {
+	if err := CheckTopicFilter(sub.Topic); err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.root == nil {
+		t.root = newTopicNode()
+	}
+	node := t.root
+	for _, level := range strings.Split(sub.Topic, topicSeparator) {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.subscribers[sub.ClientId] = sub
+	return nil
+}
+
+// 删除订阅, 同时清理空的节点
+func (t *TopicTree) Delete(filter, clientId string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.root == nil {
+		return
+	}
+	levels := strings.Split(filter, topicSeparator)
+	path := []*topicNode{t.root}
+	node := t.root
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			return
+		}
+		path = append(path, child)
+		node = child
+	}
+	delete(node.subscribers, clientId)
+
+	for i := len(levels); i > 0; i-- {
+		node := path[i]
+		if len(node.subscribers) > 0 || len(node.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+}
+
+// 查找匹配主题的所有订阅, 同一个 clientId 只返回一次
+func (t *TopicTree) Match(topic string) map[string]*Subscriber {
+	subMap := make(map[string]*Subscriber)
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.root == nil {
+		return subMap
+	}
+	levels := strings.Split(topic, topicSeparator)
+	t.root.match(levels, 0, strings.HasPrefix(topic, "$"), subMap)
+	return subMap
+}
+
+func (n *topicNode) match(levels []string, index int, system bool, subMap map[string]*Subscriber) {
+	wildcard := !(system && index == 0)
+
+	// # 同时匹配父级, sensors/# 匹配 sensors
+	if wildcard {
+		if child, ok := n.children[topicMultiLevel]; ok {
+			for clientId, sub := range child.subscribers {
+				subMap[clientId] = sub
+			}
+		}
+	}
+
+	if index == len(levels) {
+		for clientId, sub := range n.subscribers {
+			subMap[clientId] = sub
+		}
+		return
+	}
+
+	if child, ok := n.children[levels[index]]; ok {
+		child.match(levels, index+1, system, subMap)
+	}
+	if wildcard {
+		if child, ok := n.children[topicSingleLevel]; ok {
+			child.match(levels, index+1, system, subMap)
+		}
+	}
+}
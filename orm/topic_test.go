@@ -0,0 +1,187 @@
+package orm
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+var topicMatchTests = []struct {
+	filter string
+	topic  string
+	want   bool
+}{
+	{"a/b", "a/b", true},
+	{"a/b", "a/c", false},
+	{"a/b", "a/b/c", false},
+	{"a/b/c", "a/b", false},
+	{"a/+", "a/b", true},
+	{"a/+", "a/b/c", false},
+	{"a/+", "a", false},
+	{"a/+", "a/", true},
+	{"a/+/c", "a/b/c", true},
+	{"a/+/c", "a/b/d", false},
+	{"+/+", "a/b", true},
+	{"+/+", "/b", true},
+	{"+", "a", true},
+	{"+", "/a", false},
+	{"a/#", "a", true},
+	{"a/#", "a/b", true},
+	{"a/#", "a/b/c", true},
+	{"a/#", "b/a", false},
+	{"a/+/#", "a/b", true},
+	{"a/+/#", "a", false},
+	{"#", "a/b/c", true},
+	{"#", "/", true},
+	{"#", "$SYS/broker", false},
+	{"+/broker", "$SYS/broker", false},
+	{"$SYS/#", "$SYS/broker", true},
+	{"$SYS/+", "$SYS/broker", true},
+	{"$SYS/+", "$SYS/broker/clients", false},
+	{"$other/#", "$SYS/broker", false},
+	{"a/$b", "a/$b", true},
+	{"a/+", "a/$b", true},
+}
+
+func TestTopicMatch(t *testing.T) {
+	for _, tt := range topicMatchTests {
+		if got := TopicMatch(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("TopicMatch(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTopicFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		valid  bool
+	}{
+		{"a", true},
+		{"a/b/c", true},
+		{"/", true},
+		{"+", true},
+		{"#", true},
+		{"a/+/c", true},
+		{"a/#", true},
+		{"+/+/#", true},
+		{"$SYS/#", true},
+		{"", false},
+		{"a/#/c", false},
+		{"#/a", false},
+		{"a#", false},
+		{"a/b+", false},
+		{"a/+b/c", false},
+		{"a/##", false},
+	}
+	for _, tt := range tests {
+		if err := CheckTopicFilter(tt.filter); (err == nil) != tt.valid {
+			t.Errorf("CheckTopicFilter(%q) = %v, want valid %v", tt.filter, err, tt.valid)
+		}
+	}
+}
+
+func TestCheckTopicName(t *testing.T) {
+	tests := []struct {
+		topic string
+		valid bool
+	}{
+		{"a", true},
+		{"a/b/c", true},
+		{"/a", true},
+		{"$SYS/broker", true},
+		{"", false},
+		{"a/+", false},
+		{"a/#", false},
+		{"a+b", false},
+	}
+	for _, tt := range tests {
+		if err := CheckTopicName(tt.topic); (err == nil) != tt.valid {
+			t.Errorf("CheckTopicName(%q) = %v, want valid %v", tt.topic, err, tt.valid)
+		}
+	}
+}
+
+// 匹配到的 clientId, 排序后比较
+func treeMatch(tree *TopicTree, topic string) []string {
+	clientIdArr := []string{}
+	for clientId := range tree.Match(topic) {
+		clientIdArr = append(clientIdArr, clientId)
+	}
+	sort.Strings(clientIdArr)
+	return clientIdArr
+}
+
+func TestTopicTree(t *testing.T) {
+	var tree TopicTree
+	if got := treeMatch(&tree, "a"); len(got) != 0 {
+		t.Errorf("empty tree Match = %v", got)
+	}
+
+	subArr := []*Subscriber{
+		{ClientId: "exact", Topic: "sensors/1/temp"},
+		{ClientId: "single", Topic: "sensors/+/temp"},
+		{ClientId: "multi", Topic: "sensors/#"},
+		{ClientId: "all", Topic: "#"},
+		{ClientId: "root", Topic: "+"},
+		{ClientId: "sys", Topic: "$SYS/#"},
+		{ClientId: "sysone", Topic: "$SYS/+"},
+		{ClientId: "overlap", Topic: "sensors/#"},
+		{ClientId: "overlap", Topic: "sensors/+/temp"},
+	}
+	for _, sub := range subArr {
+		if err := tree.Add(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Add(&Subscriber{ClientId: "bad", Topic: "a/#/b"}); err == nil {
+		t.Error("Add invalid filter = nil")
+	}
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"sensors/1/temp", []string{"all", "exact", "multi", "overlap", "single"}},
+		{"sensors/2/temp", []string{"all", "multi", "overlap", "single"}},
+		{"sensors/1/humidity", []string{"all", "multi", "overlap"}},
+		{"sensors", []string{"all", "multi", "overlap", "root"}},
+		{"other", []string{"all", "root"}},
+		{"other/x", []string{"all"}},
+		{"$SYS/broker", []string{"sys", "sysone"}},
+		{"$SYS/broker/clients", []string{"sys"}},
+		{"$other", []string{}},
+	}
+	for _, tt := range tests {
+		if got := treeMatch(&tree, tt.topic); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%q) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+
+	// 删除后不再匹配, 空节点被清理
+	tree.Delete("sensors/+/temp", "single")
+	tree.Delete("sensors/+/temp", "overlap")
+	tree.Delete("not/exist", "single")
+	if got := treeMatch(&tree, "sensors/2/temp"); !reflect.DeepEqual(got, []string{"all", "multi", "overlap"}) {
+		t.Errorf("after Delete Match = %v", got)
+	}
+	if _, ok := tree.root.children["sensors"].children["+"]; ok {
+		t.Error("empty node sensors/+ not removed")
+	}
+	tree.Delete("sensors/1/temp", "exact")
+	if _, ok := tree.root.children["sensors"].children["1"]; ok {
+		t.Error("empty node sensors/1 not removed")
+	}
+}
+
+// 主题树与 TopicMatch 的结果一致
+func TestTopicTreeMatch(t *testing.T) {
+	for _, tt := range topicMatchTests {
+		var tree TopicTree
+		if err := tree.Add(&Subscriber{ClientId: "c", Topic: tt.filter}); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(tree.Match(tt.topic)) > 0; got != tt.want {
+			t.Errorf("tree %q Match(%q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package orm
+
+import (
+	"bufio"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+
+	长连接底层传输
+		wsTransport		websocket 文本帧, 每帧一条 json 消息
+		mqttTransport	mqtt 报文流, websocket 二进制帧或 tcp
+
+*/
+
+type transport interface {
+	ReadMessage() ([]byte, error)             // 读取一条完整消息
+	WriteMessage(data []byte) error           // 写入一条完整消息
+	WriteClose(code int, reason string) error // 发送关闭帧
+	Close() error
+	RemoteAddr() net.Addr
+}
+
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (t *wsTransport) ReadMessage() ([]byte, error) {
+	_, data, err := t.conn.ReadMessage()
+	return data, err
+}
+func (t *wsTransport) WriteMessage(data []byte) error {
+	return t.conn.WriteMessage(websocket.TextMessage, data)
+}
+func (t *wsTransport) WriteClose(code int, reason string) error {
+	return writeCloseFrame(t.conn, code, reason)
+}
+func (t *wsTransport) Close() error {
+	return t.conn.Close()
+}
+func (t *wsTransport) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+type mqttTransport struct {
+	reader     *bufio.Reader
+	write      func(data []byte) error
+	writeClose func(code int, reason string) error // 为空时不发送关闭帧
+	closer     io.Closer
+	addr       net.Addr
+}
+
+func (t *mqttTransport) ReadMessage() ([]byte, error) {
+	return ReadPacket(t.reader)
+}
+func (t *mqttTransport) WriteMessage(data []byte) error {
+	return t.write(data)
+}
+func (t *mqttTransport) WriteClose(code int, reason string) error {
+	if t.writeClose == nil {
+		return nil
+	}
+	return t.writeClose(code, reason)
+}
+func (t *mqttTransport) Close() error {
+	return t.closer.Close()
+}
+func (t *mqttTransport) RemoteAddr() net.Addr {
+	return t.addr
+}
+
+// websocket 二进制帧, 报文可以跨帧
+func newMqttWsTransport(conn *websocket.Conn) *mqttTransport {
+	return &mqttTransport{
+		reader: bufio.NewReader(&wsReader{conn: conn}),
+		write: func(data []byte) error {
+			return conn.WriteMessage(websocket.BinaryMessage, data)
+		},
+		writeClose: func(code int, reason string) error {
+			return writeCloseFrame(conn, code, reason)
+		},
+		closer: conn,
+		addr:   conn.RemoteAddr(),
+	}
+}
+
+// 关闭帧原因最大字节数, 控制帧内容不超过 125 字节, 其中 2 字节为关闭码
+const closeReasonMax = 123
+
+// websocket 关闭帧, 可以与其他写入并发调用
+func writeCloseFrame(conn *websocket.Conn, code int, reason string) error {
+	return conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, truncateReason(reason)),
+		time.Now().Add(closeWait*time.Second),
+	)
+}
+
+// 超长的关闭原因按 utf-8 字符截断
+func truncateReason(reason string) string {
+	if len(reason) <= closeReasonMax {
+		return reason
+	}
+	n := closeReasonMax
+	for n > 0 && !utf8.RuneStart(reason[n]) {
+		n--
+	}
+	return reason[:n]
+}
+
+// tcp 数据流
+func newMqttTcpTransport(conn net.Conn) *mqttTransport {
+	return &mqttTransport{
+		reader: bufio.NewReader(conn),
+		write: func(data []byte) error {
+			_, err := conn.Write(data)
+			return err
+		},
+		closer: conn,
+		addr:   conn.RemoteAddr(),
+	}
+}
+
+// 把 websocket 的多个帧当作连续的数据流读取
+type wsReader struct {
+	conn   *websocket.Conn
+	reader io.Reader
+}
+
+func (r *wsReader) Read(p []byte) (int, error) {
+	for {
+		if r.reader == nil {
+			_, reader, err := r.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			r.reader = reader
+		}
+		n, err := r.reader.Read(p)
+		if err == io.EOF {
+			r.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,32 @@
+package orm
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		reason string
+		want   int
+	}{
+		{"empty", "", 0},
+		{"short", "kicked by admin", 15},
+		{"max", strings.Repeat("a", 123), 123},
+		{"ascii", strings.Repeat("a", 200), 123},
+		{"chinese", strings.Repeat("下线", 50), 123},
+		{"chinese cut", "ab" + strings.Repeat("下线", 50), 122},
+		{"mixed", "a" + strings.Repeat("下", 50), 121},
+	}
+	for _, tt := range tests {
+		got := truncateReason(tt.reason)
+		if len(got) != tt.want {
+			t.Errorf("%s: len = %d, want %d", tt.name, len(got), tt.want)
+		}
+		if !utf8.ValidString(got) || !strings.HasPrefix(tt.reason, got) {
+			t.Errorf("%s: truncated to %q", tt.name, got)
+		}
+	}
+}
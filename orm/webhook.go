@@ -0,0 +1,233 @@
+package orm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+	webhook 回调, 事件 connect disconnect subscribe unsubscribe publish
+		WEBHOOK_URL		回调地址, 多个用逗号分隔, 为空时不启用
+		WEBHOOK_SECRET	签名密钥, 请求头 X-Webhook-Signature: sha256={hex(hmac_sha256(secret, body))}
+		WEBHOOK_EVENTS	发送的事件, 多个用逗号分隔, 为空时发送全部事件
+		WEBHOOK_FILTER	按主题过滤, 格式 事件:主题, 如 publish:sensors/#,subscribe:#
+						配置了过滤的事件只发送匹配的主题, 未配置的事件不过滤
+	每个地址一个发送队列, 异步发送, 失败后按 1s 2s 4s ... 重试, 队列满时丢弃
+
+*/
+
+const (
+	webhookQueue   = 1000 // 默认队列长度
+	webhookRetry   = 3    // 默认重试次数
+	webhookTimeout = 5    // 默认请求超时 秒
+	webhookBackoff = 30   // 最大重试间隔 秒
+)
+
+var Webhook WebhookSender
+
+type WebhookConf struct {
+	Url     string `env:"WEBHOOK_URL"`
+	Secret  string `env:"WEBHOOK_SECRET"`
+	Events  string `env:"WEBHOOK_EVENTS"`
+	Filter  string `env:"WEBHOOK_FILTER"`
+	Queue   int64  `env:"WEBHOOK_QUEUE"`   // 每个地址的队列长度
+	Retry   int64  `env:"WEBHOOK_RETRY"`   // 失败重试次数
+	Timeout int64  `env:"WEBHOOK_TIMEOUT"` // 请求超时 秒
+}
+
+type WebhookEvent struct {
+	Event    string `json:"event"`
+	ClientId string `json:"clientId"`
+	Username string `json:"username,omitempty"`
+	Ip       string `json:"ip,omitempty"`
+	Node     string `json:"node"`
+	Topic    string `json:"topic,omitempty"`
+	Message  string `json:"message,omitempty"`
+	Qos      int64  `json:"qos,omitempty"`
+	Reason   string `json:"reason,omitempty"` // 断开原因
+	Time     int64  `json:"time"`             // 事件时间 unix
+}
+
+type WebhookSender struct {
+	mutex     sync.RWMutex
+	conf      WebhookConf
+	client    *http.Client
+	events    map[string]bool     // 为空时发送全部事件
+	filterMap map[string][]string // map[事件]主题
+	queueArr  []chan []byte
+	done      chan bool
+	wg        sync.WaitGroup
+}
+
+func (w *WebhookSender) Init(conf WebhookConf) {
+	if conf.Queue <= 0 {
+		conf.Queue = webhookQueue
+	}
+	if conf.Retry <= 0 {
+		conf.Retry = webhookRetry
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = webhookTimeout
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.done != nil {
+		return
+	}
+	w.conf = conf
+	w.client = &http.Client{Timeout: time.Duration(conf.Timeout) * time.Second}
+	w.events = make(map[string]bool)
+	for _, event := range splitList(conf.Events) {
+		w.events[event] = true
+	}
+	w.filterMap = make(map[string][]string)
+	for _, item := range splitList(conf.Filter) {
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 || CheckTopicFilter(kv[1]) != nil {
+			log.Println("[webhook]", "filter error", item)
+			continue
+		}
+		w.filterMap[kv[0]] = append(w.filterMap[kv[0]], kv[1])
+	}
+
+	w.done = make(chan bool)
+	for _, url := range splitList(conf.Url) {
+		queue := make(chan []byte, conf.Queue)
+		w.queueArr = append(w.queueArr, queue)
+		w.wg.Add(1)
+		go w.loop(url, queue)
+	}
+}
+
+// 逗号分隔的列表
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// 事件是否需要发送
+func (w *WebhookSender) match(event WebhookEvent) bool {
+	if len(w.events) > 0 && !w.events[event.Event] {
+		return false
+	}
+	filterArr, ok := w.filterMap[event.Event]
+	if !ok {
+		return true
+	}
+	for _, filter := range filterArr {
+		if TopicMatch(filter, event.Topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// 加入发送队列, 不阻塞
+func (w *WebhookSender) Send(event WebhookEvent) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if len(w.queueArr) <= 0 || !w.match(event) {
+		return
+	}
+
+	if event.Time == 0 {
+		event.Time = time.Now().Unix()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, queue := range w.queueArr {
+		select {
+		case queue <- body:
+		default:
+			log.Println("[webhook]", "queue full, drop", event.Event, event.ClientId)
+		}
+	}
+}
+
+func (w *WebhookSender) loop(url string, queue chan []byte) {
+	defer w.wg.Done()
+	for {
+		select {
+		case body := <-queue:
+			w.deliver(url, body)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// 发送失败按指数退避重试
+func (w *WebhookSender) deliver(url string, body []byte) {
+	delay := time.Second
+	for i := int64(0); ; i++ {
+		err := w.post(url, body)
+		if err == nil {
+			return
+		}
+		if i >= w.conf.Retry {
+			log.Println("[webhook]", url, err.Error())
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-w.done:
+			return
+		}
+		if delay *= 2; delay > webhookBackoff*time.Second {
+			delay = webhookBackoff * time.Second
+		}
+	}
+}
+
+func (w *WebhookSender) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.conf.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.conf.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("webhook返回状态码 " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// 停止发送, 队列中未发送的事件丢弃
+func (w *WebhookSender) Close() {
+	w.mutex.Lock()
+	if w.done != nil {
+		close(w.done)
+	}
+	w.queueArr = nil
+	w.mutex.Unlock()
+	w.wg.Wait()
+}
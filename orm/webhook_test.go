@@ -0,0 +1,166 @@
+package orm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	signature string
+	body      []byte
+	event     WebhookEvent
+}
+
+// 记录收到的请求, fail 次数内返回 500
+func webhookServer(t *testing.T, fail int32) (*httptest.Server, chan webhookRequest, *int32) {
+	ch := make(chan webhookRequest, 10)
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&count, 1)
+		if n <= fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		req := webhookRequest{signature: r.Header.Get("X-Webhook-Signature"), body: body}
+		if err := json.Unmarshal(body, &req.event); err != nil {
+			t.Errorf("body %s: %v", body, err)
+		}
+		ch <- req
+	}))
+	t.Cleanup(ts.Close)
+	return ts, ch, &count
+}
+
+func webhookRecv(t *testing.T, ch chan webhookRequest, timeout time.Duration) webhookRequest {
+	select {
+	case req := <-ch:
+		return req
+	case <-time.After(timeout):
+		t.Fatal("webhook timeout")
+	}
+	return webhookRequest{}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	ts, ch, _ := webhookServer(t, 0)
+	var w WebhookSender
+	w.Init(WebhookConf{Url: ts.URL, Secret: "key"})
+	defer w.Close()
+
+	w.Send(WebhookEvent{Event: "publish", ClientId: "c1", Topic: "a/b", Message: "hello", Qos: 1})
+	req := webhookRecv(t, ch, time.Second)
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write(req.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.signature != want {
+		t.Errorf("signature = %q, want %q", req.signature, want)
+	}
+	if req.event.Event != "publish" || req.event.ClientId != "c1" || req.event.Message != "hello" || req.event.Time == 0 {
+		t.Errorf("event = %+v", req.event)
+	}
+}
+
+func TestWebhookNoSecret(t *testing.T) {
+	ts, ch, _ := webhookServer(t, 0)
+	var w WebhookSender
+	w.Init(WebhookConf{Url: ts.URL})
+	defer w.Close()
+
+	w.Send(WebhookEvent{Event: "connect", ClientId: "c1"})
+	if req := webhookRecv(t, ch, time.Second); req.signature != "" {
+		t.Errorf("signature without secret = %q", req.signature)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	ts, ch, count := webhookServer(t, 1)
+	var w WebhookSender
+	w.Init(WebhookConf{Url: ts.URL, Retry: 1})
+	defer w.Close()
+
+	// 第一次 500, 1s 后重试成功
+	w.Send(WebhookEvent{Event: "connect", ClientId: "c1"})
+	req := webhookRecv(t, ch, 3*time.Second)
+	if req.event.ClientId != "c1" || atomic.LoadInt32(count) != 2 {
+		t.Errorf("event = %+v, requests = %d", req.event, atomic.LoadInt32(count))
+	}
+}
+
+func TestWebhookRetryLimit(t *testing.T) {
+	ts, ch, count := webhookServer(t, 100)
+	var w WebhookSender
+	w.Init(WebhookConf{Url: ts.URL, Retry: 1})
+	defer w.Close()
+
+	// 重试次数用完后丢弃
+	w.Send(WebhookEvent{Event: "connect", ClientId: "c1"})
+	time.Sleep(1500 * time.Millisecond)
+	if n := atomic.LoadInt32(count); n != 2 {
+		t.Errorf("requests = %d, want 2", n)
+	}
+	select {
+	case req := <-ch:
+		t.Errorf("unexpected %+v", req.event)
+	default:
+	}
+}
+
+func TestWebhookFilter(t *testing.T) {
+	ts, ch, count := webhookServer(t, 0)
+	var w WebhookSender
+	w.Init(WebhookConf{Url: ts.URL, Events: "publish, subscribe,disconnect", Filter: "publish:sensors/#,subscribe:a/+,bad,publish:a/#/b"})
+	defer w.Close()
+
+	tests := []struct {
+		event WebhookEvent
+		send  bool
+	}{
+		{WebhookEvent{Event: "connect", ClientId: "c1"}, false},
+		{WebhookEvent{Event: "publish", ClientId: "c2", Topic: "other/1"}, false},
+		{WebhookEvent{Event: "subscribe", ClientId: "c3", Topic: "a/b/c"}, false},
+		{WebhookEvent{Event: "publish", ClientId: "c4", Topic: "sensors/1/temp"}, true},
+		{WebhookEvent{Event: "subscribe", ClientId: "c5", Topic: "a/b"}, true},
+		{WebhookEvent{Event: "disconnect", ClientId: "c6"}, true},
+	}
+	for _, tt := range tests {
+		w.Send(tt.event)
+	}
+	for _, tt := range tests {
+		if !tt.send {
+			continue
+		}
+		if req := webhookRecv(t, ch, time.Second); req.event.ClientId != tt.event.ClientId {
+			t.Errorf("recv %s, want %s", req.event.ClientId, tt.event.ClientId)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(count); n != 3 {
+		t.Errorf("requests = %d, want 3", n)
+	}
+}
+
+func TestWebhookDisabled(t *testing.T) {
+	var w WebhookSender
+	w.Init(WebhookConf{})
+	w.Send(WebhookEvent{Event: "connect", ClientId: "c1"})
+	w.Close()
+
+	// 关闭后不再发送
+	ts, _, count := webhookServer(t, 0)
+	var closed WebhookSender
+	closed.Init(WebhookConf{Url: ts.URL})
+	closed.Close()
+	closed.Send(WebhookEvent{Event: "connect", ClientId: "c1"})
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(count); n != 0 {
+		t.Errorf("requests after Close = %d", n)
+	}
+}
@@ -1,19 +1,42 @@
 package orm
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	heartbeatTotal = 10 // 心跳最多监控次数
 	heartbeatWait  = 10 // 心跳等待时间
+	closeWait      = 5  // 发送最后一条消息的等待时间
+
+	subprotocolToken = "access_token." // 子协议传递 token 的前缀
+
+	// websocket 关闭码
+	CloseCodeKick      = 4000 // 管理员踢下线
+	CloseCodeDuplicate = 4001 // clientId 已在线, 拒绝新连接
+	CloseCodeTakeover  = 4002 // clientId 重新连接, 旧连接被接管
+	CloseCodeAuth      = 4003 // connect 消息验证失败
+	CloseCodeRevoked   = 4004 // token 被撤销
+	CloseCodeExpired   = 4005 // token 已过期, 客户端可以在过期前发送 auth 消息更新 token
+
+	// 连接关闭原因
+	CloseReasonTakeover       = "session taken over"
+	CloseReasonTakeoverRemote = "session taken over by another node"
+	CloseReasonTokenExpired   = "token expired"
+	CloseReasonTokenRevoked   = "token revoked"
 )
 
 //升级长连接
@@ -21,62 +44,245 @@ var WS = websocket.Upgrader{
 	ReadBufferSize:   1024,
 	WriteBufferSize:  1024,
 	HandshakeTimeout: 60 * time.Second,
+	Subprotocols:     []string{"json"}, // 浏览器通过子协议传递 token 时, 没有带上 json 则回应 access_token 子协议
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+//升级 mqtt over websocket 长连接
+var WSMqtt = websocket.Upgrader{
+	ReadBufferSize:   1024,
+	WriteBufferSize:  1024,
+	HandshakeTimeout: 60 * time.Second,
+	Subprotocols:     []string{"mqtt", "mqttv3.1"},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
+// 连接信息
+type ConnectionInfo struct {
+	ClientId    string    `json:"clientId"`
+	Username    string    `json:"username"`
+	Ip          string    `json:"ip"`
+	Protocol    string    `json:"protocol"` // json mqtt
+	ConnectTime time.Time `json:"connectTime"`
+}
+
 type Connection struct {
-	wsConnect    *websocket.Conn
+	info         ConnectionInfo
+	identity     *Identity // 验证结果
+	transport    transport
+	encoder      func(OnelineMessage) ([]byte, error) // 消息编码, 默认 json
+	lastRead     int64                                // 最近收到消息的时间 UnixNano
 	inChan       chan []byte
 	outChan      chan []byte
 	closeChan    chan byte
 	mutex        sync.Mutex // 对closeChan关闭上锁
 	isClosed     bool       // 防止closeChan被关闭多次
+	closeReason  string     // 连接关闭原因
+	closeAfter   string     // 发送完成后关闭的原因, WriteAndClose 使用
 	heartbeatNum int64      // 心跳监控次数
+
+	held    bool             // 暂存 Send 的消息, Release 后发送
+	heldArr []OnelineMessage // 暂存的消息
 }
 
 type OnelineMessage struct {
-	Action   string `json:"action"`             // action:	heartbeat	publish		subscribe	unsubscribe
-	ClientId string `json:"clientId,omitempty"` //
+	Action   string `json:"action"`             // action:	heartbeat	connect		disconnect	publish		send	subscribe	unsubscribe		ack		puback		auth	error
+	Id       string `json:"id,omitempty"`       // 消息id, 服务端生成, qos 1 时客户端 ack 使用
+	ClientId string `json:"clientId,omitempty"` //	publish 时为接收方, * 发送给所有订阅者, send 时为接收方
+	From     string `json:"from,omitempty"`     // 发送方 clientId
 	Topic    string `json:"topic,omitempty"`    //
 	Message  string `json:"message,omitempty"`  //
+	Qos      int64  `json:"qos,omitempty"`      // 0 最多一次	1 至少一次
+	Dup      bool   `json:"dup,omitempty"`      // 重发的消息
+	Retain   bool   `json:"retain,omitempty"`   // 保留消息, message 为空时清除该主题的保留消息
+
+	Will     *OnelineMessage `json:"will,omitempty"`     // connect 时设置遗嘱消息, 连接异常断开时发布
+	Username string          `json:"username,omitempty"` // connect 时验证的帐号, token 可放在 username 或 password
+	Password string          `json:"password,omitempty"` //
+	Token    string          `json:"token,omitempty"`    // auth 时的新 token
+}
+
+// 生成消息id
+func NewMessageId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + hex.EncodeToString(b)
 }
 
 func InitConnection(c *gin.Context) (*Connection, error) {
-	wsConn, err := WS.Upgrade(c.Writer, c.Request, nil)
+	// 浏览器要求回应的子协议是请求中的一个, 优先回应 json
+	upgrader := WS
+	if token := SubprotocolToken(c.Request); token != "" {
+		upgrader.Subprotocols = append(append([]string{}, WS.Subprotocols...), subprotocolToken+token)
+	}
+	wsConn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := newConnection(&wsTransport{conn: wsConn}, c.ClientIP(), "json")
+	go conn.heartbeatLoop()
+	return conn, nil
+}
+
+// mqtt over websocket, 需要客户端使用 mqtt 子协议, 心跳由 CONNECT 中的 keepAlive 决定
+func InitMqttConnection(c *gin.Context) (*Connection, error) {
+	if !websocketMqtt(c.Request) {
+		return nil, errors.New("请使用 mqtt 子协议连接")
+	}
+	wsConn, err := WSMqtt.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		return nil, err
 	}
+	return newConnection(newMqttWsTransport(wsConn), c.ClientIP(), "mqtt"), nil
+}
+
+// tcp 或 tls 长连接, 使用 mqtt 协议
+func InitTcpConnection(netConn net.Conn) *Connection {
+	ip, _, _ := net.SplitHostPort(netConn.RemoteAddr().String())
+	return newConnection(newMqttTcpTransport(netConn), ip, "mqtt")
+}
+
+// 子协议中的 token, 格式 access_token.{token}
+func SubprotocolToken(r *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, subprotocolToken) {
+			return strings.TrimPrefix(protocol, subprotocolToken)
+		}
+	}
+	return ""
+}
 
+func websocketMqtt(r *http.Request) bool {
+	for _, protocol := range websocket.Subprotocols(r) {
+		for _, v := range WSMqtt.Subprotocols {
+			if protocol == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newConnection(t transport, ip, protocol string) *Connection {
 	conn := &Connection{
-		wsConnect:    wsConn,
+		transport:    t,
 		inChan:       make(chan []byte, 1000),
 		outChan:      make(chan []byte, 1000),
 		closeChan:    make(chan byte, 1),
 		heartbeatNum: 0,
+		lastRead:     time.Now().UnixNano(),
+		info: ConnectionInfo{
+			Ip:          ip,
+			Protocol:    protocol,
+			ConnectTime: time.Now(),
+		},
 	}
 
 	// 启动读写协程
 	go conn.readLoop()
 	go conn.writeLoop()
-	go conn.heartbeatLoop()
-	return conn, nil
+	return conn
+}
+
+// 设置消息编码
+func (conn *Connection) SetEncoder(encoder func(OnelineMessage) ([]byte, error)) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.encoder = encoder
+}
+
+// 登记客户端及帐号
+func (conn *Connection) SetClient(clientId, username string) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.info.ClientId = clientId
+	conn.info.Username = username
+}
+
+// 登记验证结果
+func (conn *Connection) SetIdentity(identity *Identity) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.identity = identity
+}
+
+// 验证结果, 未登记时为 nil
+func (conn *Connection) Identity() *Identity {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.identity
+}
+
+// 连接信息
+func (conn *Connection) Info() ConnectionInfo {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.info
+}
+
+// 客户端地址
+func (conn *Connection) RemoteAddr() string {
+	return conn.transport.RemoteAddr().String()
+}
+
+// mqtt 心跳, 超过 1.5 倍 keepAlive 未收到报文断开连接
+func (conn *Connection) KeepAlive(keepAlive time.Duration) {
+	if keepAlive <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(keepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				lastRead := time.Unix(0, atomic.LoadInt64(&conn.lastRead))
+				if time.Since(lastRead) > keepAlive*3/2 {
+					conn.CloseWithReason("heartbeat timeout")
+					return
+				}
+			case <-conn.closeChan:
+				return
+			}
+		}
+	}()
 }
 func (conn *Connection) Close() {
+	conn.CloseWithReason("closed")
+}
+
+// 关闭连接并记录原因, 只记录第一次关闭的原因
+func (conn *Connection) CloseWithReason(reason string) {
 	conn.mutex.Lock()
 	defer conn.mutex.Unlock()
 
 	// 线程安全，可多次调用
-	conn.wsConnect.Close()
+	conn.transport.Close()
 
 	// 利用标记，让closeChan只关闭一次
 	if !conn.isClosed {
 		close(conn.closeChan)
 		conn.isClosed = true
+		conn.closeReason = reason
 	}
 
 }
+
+// 发送关闭帧后关闭连接, tcp 连接没有关闭帧直接关闭
+func (conn *Connection) CloseWithCode(code int, reason string) {
+	conn.transport.WriteClose(code, reason)
+	conn.CloseWithReason(reason)
+}
+func (conn *Connection) CloseReason() string {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.closeReason
+}
 func (conn *Connection) IsClosed() bool {
 	return conn.isClosed
 }
@@ -98,7 +304,7 @@ func (conn *Connection) heartbeatLoop() {
 		conn.heartbeatNum++
 	}
 ERR:
-	conn.Close()
+	conn.CloseWithReason("heartbeat timeout")
 }
 
 func (conn *Connection) ReadMessage() ([]byte, error) {
@@ -116,9 +322,10 @@ func (conn *Connection) readLoop() {
 		err  error
 	)
 	for {
-		if _, data, err = conn.wsConnect.ReadMessage(); err != nil {
+		if data, err = conn.transport.ReadMessage(); err != nil {
 			goto ERR
 		}
+		atomic.StoreInt64(&conn.lastRead, time.Now().UnixNano())
 
 		//阻塞在这里，等待inChan有空闲位置
 		select {
@@ -128,7 +335,7 @@ func (conn *Connection) readLoop() {
 		}
 	}
 ERR:
-	conn.Close()
+	conn.CloseWithReason("read error")
 }
 
 func (conn *Connection) WriteMessage(data []byte) error {
@@ -139,6 +346,91 @@ func (conn *Connection) WriteMessage(data []byte) error {
 	}
 	return nil
 }
+
+// 发送最后一条消息后关闭连接, 等待发送完成或超时
+func (conn *Connection) WriteAndClose(data []byte, reason string) {
+	conn.mutex.Lock()
+	conn.closeAfter = reason
+	conn.mutex.Unlock()
+
+	// nil 作为关闭标记, 写协程发送完前面的消息后关闭连接
+	if conn.WriteMessage(data) == nil && conn.WriteMessage(nil) == nil {
+		select {
+		case <-conn.closeChan:
+		case <-time.After(closeWait * time.Second):
+		}
+	}
+	conn.CloseWithReason(reason)
+}
+
+// 暂存之后 Send 的消息, 注册在线后到发送完离线消息前使用, 保证消息的顺序
+func (conn *Connection) Hold() {
+	conn.mutex.Lock()
+	conn.held = true
+	conn.mutex.Unlock()
+}
+
+// 先发送 first, 再按顺序发送暂存的消息, 然后恢复直接发送
+func (conn *Connection) Release(first []OnelineMessage) {
+	for _, msg := range first {
+		conn.send(msg)
+	}
+	for {
+		conn.mutex.Lock()
+		msgArr := conn.heldArr
+		conn.heldArr = nil
+		if len(msgArr) <= 0 {
+			conn.held = false
+			conn.mutex.Unlock()
+			return
+		}
+		conn.mutex.Unlock()
+		for _, msg := range msgArr {
+			conn.send(msg)
+		}
+	}
+}
+
+// 发送消息给客户端, 编码后为空的消息不发送
+func (conn *Connection) Send(onelineMessage OnelineMessage) error {
+	conn.mutex.Lock()
+	if conn.held {
+		conn.heldArr = append(conn.heldArr, onelineMessage)
+		conn.mutex.Unlock()
+		return nil
+	}
+	conn.mutex.Unlock()
+	return conn.send(onelineMessage)
+}
+
+func (conn *Connection) send(onelineMessage OnelineMessage) error {
+	conn.mutex.Lock()
+	encoder := conn.encoder
+	conn.mutex.Unlock()
+	if encoder == nil {
+		encoder = func(msg OnelineMessage) ([]byte, error) {
+			return json.Marshal(msg)
+		}
+	}
+
+	data, err := encoder(onelineMessage)
+	if err != nil {
+		return err
+	}
+	if len(data) <= 0 {
+		return nil
+	}
+	return conn.WriteMessage(data)
+}
+
+// 返回错误信息给客户端
+func (conn *Connection) WriteError(topic string, err error) error {
+	return conn.Send(OnelineMessage{
+		Action:  "error",
+		Topic:   topic,
+		Message: err.Error(),
+	})
+}
 func (conn *Connection) writeLoop() {
 	var (
 		data []byte
@@ -150,10 +442,17 @@ func (conn *Connection) writeLoop() {
 		case <-conn.closeChan:
 			goto ERR
 		}
-		if err = conn.wsConnect.WriteMessage(websocket.TextMessage, data); err != nil {
+		if data == nil {
+			conn.mutex.Lock()
+			reason := conn.closeAfter
+			conn.mutex.Unlock()
+			conn.CloseWithReason(reason)
+			return
+		}
+		if err = conn.transport.WriteMessage(data); err != nil {
 			goto ERR
 		}
 	}
 ERR:
-	conn.Close()
+	conn.CloseWithReason("write error")
 }
@@ -1,6 +1,7 @@
 package router
 
 import (
+	"crypto/subtle"
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
@@ -9,13 +10,13 @@ import (
 	"gmqtt/orm"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 // 中间件
+// 帐号信息依次读取 Authorization 头, 子协议 access_token.{token}, url 参数 username password
 func AuthWebsocket() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		username := c.Query("username")
-		password := c.Query("password")
 		clientId := c.Query("clientId")
 
 		if clientId == "" {
@@ -28,98 +29,86 @@ func AuthWebsocket() gin.HandlerFunc {
 		}
 		c.Set("clientId", clientId)
 
-		switch orm.Config.Auth {
-		case "redis":
-			if username == "" {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"code":    -1,
-					"message": "参数传递错误",
-				})
-				c.Abort()
-				return
-			}
+		if orm.Config.NoQuery && (c.Query("username") != "" || c.Query("password") != "") {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    -1,
+				"message": "禁止在url参数中传递帐号密码",
+			})
+			c.Abort()
+			return
+		}
+		credentials, ok := readCredentials(c)
+		if !ok && orm.Config.AuthFrame {
+			// 在第一条 connect 消息中验证
+			c.Next()
+			return
+		}
+		credentials.ClientId = clientId
 
-			flag, err := orm.Redis.Exists(username)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"code":    -1,
-					"message": err.Error(),
-				})
-				c.Abort()
-				return
-			}
-			if !flag {
-				c.JSON(http.StatusGone, gin.H{
-					"code":    -1,
-					"message": "帐号不存在",
-				})
-				c.Abort()
-				return
+		identity, err := orm.Auth.Authenticate(c.Request.Context(), credentials)
+		if err != nil {
+			status := http.StatusBadRequest
+			if authErr, ok := err.(*orm.AuthError); ok {
+				status = authErr.Status
 			}
+			c.JSON(status, gin.H{
+				"code":    -1,
+				"message": err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		c.Set("username", identity.Username)
+		c.Set(orm.IdentityKey, identity)
+		c.Next()
+	}
+}
 
-			passwordRedis, err := orm.Redis.HGet(username, "password")
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"code":    -1,
-					"message": err.Error(),
-				})
-				c.Abort()
-				return
-			}
-			if password != passwordRedis {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"code":    -1,
-					"message": "password is wrong",
-				})
-				c.Abort()
-				return
-			}
-		case "mysql":
-			if username == "" {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"code":    -1,
-					"message": "参数传递错误",
-				})
-				c.Abort()
-				return
-			}
-			flag, err := orm.MySql.Check(username, password)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"code":    -1,
-					"message": err.Error(),
-				})
-				c.Abort()
-				return
-			}
+// 读取握手时的帐号信息, 没有时返回 false
+func readCredentials(c *gin.Context) (orm.Credentials, bool) {
+	var credentials orm.Credentials
+	authorization := c.GetHeader("Authorization")
+	switch {
+	case strings.HasPrefix(authorization, "Bearer "):
+		credentials.Token = strings.TrimPrefix(authorization, "Bearer ")
+		return credentials, true
+	case strings.HasPrefix(authorization, "Basic "):
+		if username, password, ok := c.Request.BasicAuth(); ok {
+			credentials.Username = username
+			credentials.Password = password
+			return credentials, true
+		}
+	}
+	if token := orm.SubprotocolToken(c.Request); token != "" {
+		credentials.Token = token
+		return credentials, true
+	}
+	if !orm.Config.NoQuery {
+		credentials.Username = c.Query("username")
+		credentials.Password = c.Query("password")
+	}
+	return credentials, credentials.Username != "" || credentials.Password != ""
+}
 
-			if !flag {
-				c.JSON(http.StatusGone, gin.H{
-					"code":    -1,
-					"message": "帐号不存在",
-				})
-				c.Abort()
-				return
-			}
-		case "wjt":
-			if username == "" {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"code":    -1,
-					"message": "参数传递错误",
-				})
-				c.Abort()
-				return
-			}
-			if _, err := orm.Token.ParseToken(username); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"code":    -1,
-					"message": err.Error(),
-				})
-				c.Abort()
-				return
-			}
-		default:
-			//开放权限
+// 管理接口, 请求头 Authorization: Bearer {HOST_ADMIN_TOKEN}
+func AuthAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if orm.Config.Admin == "" {
+			c.JSON(http.StatusForbidden, gin.H{
+				"code":    -1,
+				"message": "管理接口未开启",
+			})
+			c.Abort()
+			return
+		}
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(orm.Config.Admin)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code":    -1,
+				"message": "管理密钥错误",
+			})
+			c.Abort()
+			return
 		}
 		c.Next()
 	}
@@ -127,7 +116,7 @@ func AuthWebsocket() gin.HandlerFunc {
 
 func AuthWJT() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if orm.Config.Auth != "wjt" {
+		if !orm.AuthEnabled(orm.AuthWjt) {
 			c.JSON(http.StatusBadRequest, gin.H{
 				"code":    -1,
 				"message": "验证方式错误#" + orm.Config.Auth,
@@ -140,7 +129,7 @@ func AuthWJT() gin.HandlerFunc {
 }
 func AuthRedis() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if orm.Config.Auth != "redis" {
+		if !orm.AuthEnabled(orm.AuthRedis) {
 			c.JSON(http.StatusBadRequest, gin.H{
 				"code":    -1,
 				"message": "验证方式错误#" + orm.Config.Auth,
@@ -169,6 +158,22 @@ func HttpStart() error {
 		c.String(http.StatusOK, "PONG")
 	})
 
+	// 消息中间件状态
+	router.GET("/health", func(c *gin.Context) {
+		if err := orm.MQ.Health(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"code":    -1,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    1,
+			"message": "OK",
+			"data":    orm.Config.Broker,
+		})
+	})
+
 	// 404
 	router.NoRoute(func(c *gin.Context) {
 		//返回404状态码
@@ -190,14 +195,37 @@ func HttpStart() error {
 	{
 		mqtt.GET("", api.Mqtt)
 	}
+	// mqtt 3.1.1 over websocket, 在 CONNECT 报文中验证帐号
+	router.GET("/mqtt/ws", api.MqttWs)
+
+	admin := router.Group("admin", AuthAdmin())
+	{
+		admin.GET("clients", api.ClientList)
+		admin.GET("clients/:clientId", api.ClientGet)
+		admin.DELETE("clients/:clientId", api.ClientKick)
+		admin.POST("revoke", api.TokenRevoke)
+		admin.GET("presence", api.PresenceList)
+		admin.GET("presence/:clientId", api.PresenceGet)
+	}
+
+	// 后台服务发布消息
+	publish := router.Group("publish", AuthAdmin())
+	{
+		publish.POST("", api.HttpPublish)
+		publish.POST("batch", api.HttpPublishBatch)
+	}
+	router.POST("/send", AuthAdmin(), api.HttpSend)
 
 	account := router.Group("account")
 	{
 		wjt := account.Group("wjt", AuthWJT())
 		{
-			wjt.GET(":id", api.WjtGet)
+			wjt.GET(":id", AuthAdmin(), api.WjtGet)
+			wjt.POST("", AuthAdmin(), api.WjtIssue)
+			wjt.POST("refresh", api.WjtRefresh)
 		}
-		redis := account.Group("redis", AuthRedis())
+		// 帐号的 roles 字段决定主题权限, 需要管理密钥
+		redis := account.Group("redis", AuthRedis(), AuthAdmin())
 		{
 			redis.POST("", api.RedisCreate)
 			redis.GET(":username", api.RedisGet)
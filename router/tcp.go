@@ -0,0 +1,78 @@
+package router
+
+import (
+	"crypto/tls"
+	"gmqtt/api"
+	"gmqtt/orm"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// 开启 mqtt tcp 服务, 帐号在 CONNECT 报文中验证
+func MqttStart(conf orm.MqttConf) error {
+	if conf.Port <= 0 {
+		return nil
+	}
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(int(conf.Port)))
+	if err != nil {
+		return err
+	}
+	log.Println("[mqtt] tcp listen", conf.Port)
+	return serveMqtt(listener)
+}
+
+// 开启 mqtt tls 服务
+func MqttTlsStart(conf orm.MqttConf) error {
+	if conf.TlsPort <= 0 {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(conf.TlsCert, conf.TlsKey)
+	if err != nil {
+		return err
+	}
+	listener, err := tls.Listen("tcp", ":"+strconv.Itoa(int(conf.TlsPort)), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("[mqtt] tls listen", conf.TlsPort)
+	return serveMqtt(listener)
+}
+
+func serveMqtt(listener net.Listener) error {
+	defer listener.Close()
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// 临时错误等待后重试
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go serveMqttConn(conn)
+	}
+}
+
+// 处理一个 tcp 连接, panic 时只断开该连接
+func serveMqttConn(conn net.Conn) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("[mqtt] panic", conn.RemoteAddr(), err)
+			conn.Close()
+		}
+	}()
+	api.ServeMqtt(orm.InitTcpConnection(conn))
+}